@@ -18,9 +18,6 @@
 
 set +x
 
-# TLS auto reload script
-#/opt/ats/bin/tls-reload.sh >> /opt/ats/var/log/ingress/ingress_ats.err &
-
 # generate TLS cert config file for ats 
 /opt/ats/bin/tls-config.sh 
 
@@ -53,8 +50,50 @@ if [ -z "${RESYNC_PERIOD}" ]; then
   RESYNC_PERIOD="0"
 fi
 
+if [ -z "${USE_ENDPOINT_SLICES}" ]; then
+  USE_ENDPOINT_SLICES="false"
+fi
+
+if [ -z "${DRAIN_TIMEOUT}" ]; then
+  DRAIN_TIMEOUT="30s"
+fi
+
+if [ -z "${RECONCILE_PERIOD}" ]; then
+  RECONCILE_PERIOD="5m"
+fi
+
+if [ -z "${LEADER_ELECT}" ]; then
+  LEADER_ELECT="false"
+fi
+
+if [ -z "${LEASE_NAME}" ]; then
+  LEASE_NAME="ats-ingress-controller"
+fi
+
+if [ -z "${INGRESS_CONTROLLER}" ]; then
+  INGRESS_CONTROLLER="trafficserver.apache.org/ingress-controller"
+fi
+
+if [ -z "${INGRESS_CLASS_ANNOTATION}" ]; then
+  INGRESS_CLASS_ANNOTATION="true"
+fi
+
+if [ -z "${SSL_REDIRECT}" ]; then
+  SSL_REDIRECT="false"
+fi
+
+# the controller accepts snippets when ATS runs them
+SNIPPETS="false"
+if [ ! -z "${SNIPPET}" ]; then
+  SNIPPETS="true"
+fi
+
+if [ -z "${SNIPPET_NAMESPACES}" ]; then
+  SNIPPET_NAMESPACES="all"
+fi
+
 if [ -z "${INGRESS_DEBUG}" ]; then
-  /opt/ats/bin/ingress_ats -atsIngressClass="$INGRESS_CLASS" -atsNamespace="$POD_NAMESPACE" -namespaces="$INGRESS_NS" -ignoreNamespaces="$INGRESS_IGNORE_NS" -useInClusterConfig=T -resyncPeriod="$RESYNC_PERIOD"
+  /opt/ats/bin/ingress_ats -atsIngressClass="$INGRESS_CLASS" -ingressController="$INGRESS_CONTROLLER" -ingressClassAnnotation="$INGRESS_CLASS_ANNOTATION" -atsNamespace="$POD_NAMESPACE" -namespaces="$INGRESS_NS" -ignoreNamespaces="$INGRESS_IGNORE_NS" -useInClusterConfig=T -resyncPeriod="$RESYNC_PERIOD" -useEndpointSlices="$USE_ENDPOINT_SLICES" -drainTimeout="$DRAIN_TIMEOUT" -reconcilePeriod="$RECONCILE_PERIOD" -leaderElect="$LEADER_ELECT" -leaseName="$LEASE_NAME" -leaseNamespace="$LEASE_NAMESPACE" -publishService="$PUBLISH_SERVICE" -publishStatusAddress="$PUBLISH_STATUS_ADDRESS" -tlsCertDir="$TLS_CERT_DIR" -defaultSSLCertificate="$DEFAULT_SSL_CERTIFICATE" -sslRedirect="$SSL_REDIRECT" -snippets="$SNIPPETS" -snippetNamespaces="$SNIPPET_NAMESPACES"
 else
-  /opt/ats/bin/ingress_ats -atsIngressClass="$INGRESS_CLASS" -atsNamespace="$POD_NAMESPACE" -namespaces="$INGRESS_NS" -ignoreNamespaces="$INGRESS_IGNORE_NS" -useInClusterConfig=T -resyncPeriod="$RESYNC_PERIOD" 2>>/opt/ats/var/log/ingress/ingress_ats.err
+  /opt/ats/bin/ingress_ats -atsIngressClass="$INGRESS_CLASS" -ingressController="$INGRESS_CONTROLLER" -ingressClassAnnotation="$INGRESS_CLASS_ANNOTATION" -atsNamespace="$POD_NAMESPACE" -namespaces="$INGRESS_NS" -ignoreNamespaces="$INGRESS_IGNORE_NS" -useInClusterConfig=T -resyncPeriod="$RESYNC_PERIOD" -useEndpointSlices="$USE_ENDPOINT_SLICES" -drainTimeout="$DRAIN_TIMEOUT" -reconcilePeriod="$RECONCILE_PERIOD" -leaderElect="$LEADER_ELECT" -leaseName="$LEASE_NAME" -leaseNamespace="$LEASE_NAMESPACE" -publishService="$PUBLISH_SERVICE" -publishStatusAddress="$PUBLISH_STATUS_ADDRESS" -tlsCertDir="$TLS_CERT_DIR" -defaultSSLCertificate="$DEFAULT_SSL_CERTIFICATE" -sslRedirect="$SSL_REDIRECT" -snippets="$SNIPPETS" -snippetNamespaces="$SNIPPET_NAMESPACES" 2>>/opt/ats/var/log/ingress/ingress_ats.err
 fi
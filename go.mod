@@ -5,6 +5,7 @@ go 1.25.11
 require (
 	github.com/alicebob/miniredis/v2 v2.31.1
 	github.com/go-redis/redis v6.15.9+incompatible
+	github.com/yuin/gopher-lua v1.1.0
 	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/api v0.27.9
 	k8s.io/apimachinery v0.27.9
@@ -21,6 +22,7 @@ require (
 	github.com/go-openapi/jsonreference v0.20.1 // indirect
 	github.com/go-openapi/swag v0.22.3 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
+	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/google/gnostic v0.6.9 // indirect
 	github.com/google/go-cmp v0.5.9 // indirect
@@ -36,7 +38,6 @@ require (
 	github.com/onsi/ginkgo v1.16.5 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/yuin/gopher-lua v1.1.0 // indirect
 	golang.org/x/net v0.55.0 // indirect
 	golang.org/x/oauth2 v0.27.0 // indirect
 	golang.org/x/sys v0.45.0 // indirect
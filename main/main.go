@@ -16,6 +16,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
@@ -28,8 +29,10 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 
-	_ "k8s.io/client-go/util/workqueue"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	_ "k8s.io/api/networking/v1"
 
@@ -53,10 +56,33 @@ var (
 	namespaces       = flag.String("namespaces", namespace.ALL, "Comma separated list of namespaces to watch for ingress and endpoints.")
 	ignoreNamespaces = flag.String("ignoreNamespaces", "", "Comma separated list of namespaces to ignore for ingress and endpoints.")
 
-	atsNamespace    = flag.String("atsNamespace", "default", "Name of Namespace the ATS pod resides.")
-	atsIngressClass = flag.String("atsIngressClass", "", "Ingress Class of Ingress object that ATS will retrieve routing info from")
+	atsNamespace           = flag.String("atsNamespace", "default", "Name of Namespace the ATS pod resides.")
+	atsIngressClass        = flag.String("atsIngressClass", "", "Ingress Class of Ingress object that ATS will retrieve routing info from")
+	ingressClassAnnotation = flag.Bool("ingressClassAnnotation", true, "Set to false to ignore ingresses whose class is only given by the legacy kubernetes.io/ingress.class annotation.")
+	ingressController      = flag.String("ingressController", "trafficserver.apache.org/ingress-controller", "The spec.controller of the IngressClasses whose ingresses ATS will retrieve routing info from. Set to empty to not watch IngressClasses.")
+
+	tlsCertDir = flag.String("tlsCertDir", "", "Directory the certificates of the secrets referenced by the tls section of the ingresses are written to, e.g. /opt/ats/etc/trafficserver/certs. They are not managed when empty.")
+
+	defaultSSLCertificate = flag.String("defaultSSLCertificate", "", "The namespace/name of the secret of the certificate for hosts without one in the tls section of the ingresses. A self-signed certificate is generated when none is given nor mounted. Only used with tlsCertDir.")
+
+	snippets          = flag.Bool("snippets", false, "Set to true to accept the ats.ingress.kubernetes.io/server-snippet annotations of the ingresses, whose Lua ATS runs for their requests.")
+	snippetNamespaces = flag.String("snippetNamespaces", namespace.ALL, "Comma separated list of namespaces whose ingresses may have snippets. Only used with snippets.")
+
+	sslRedirect = flag.Bool("sslRedirect", false, "Set to true to redirect http requests for the hosts in the tls section of the ingresses to https. The ats.ingress.kubernetes.io/ssl-redirect annotation overrides it per ingress.")
 
 	resyncPeriod = flag.Duration("resyncPeriod", 0*time.Second, "Resync period for the cache of informer")
+
+	useEndpointSlices = flag.Bool("useEndpointSlices", false, "Set to true to discover backends from EndpointSlices instead of Endpoints.")
+	drainTimeout      = flag.Duration("drainTimeout", 30*time.Second, "How long terminating endpoints stay routable while a service has no ready endpoint. Only used with EndpointSlices.")
+
+	reconcilePeriod = flag.Duration("reconcilePeriod", 5*time.Minute, "How often the Redis routing tables are reconciled with the cluster state. Set to 0 to only reconcile at startup and on SIGHUP.")
+
+	leaderElect    = flag.Bool("leaderElect", false, "Set to true to elect a leader among the controller replicas through a Lease. Only the leader writes to cluster-scoped resources such as Ingress statuses.")
+	leaseName      = flag.String("leaseName", "ats-ingress-controller", "Name of the Lease used for leader election.")
+	leaseNamespace = flag.String("leaseNamespace", "", "Namespace of the Lease used for leader election. Defaults to atsNamespace.")
+
+	publishService       = flag.String("publishService", "", "The namespace/name of the ATS Service, whose external IPs, or else the IPs of the nodes running it, are published to the status of the ingresses.")
+	publishStatusAddress = flag.String("publishStatusAddress", "", "Comma separated list of IPs or hostnames published to the status of the ingresses. Takes precedence over publishService.")
 )
 
 func init() {
@@ -161,6 +187,54 @@ func main() {
 		ResyncPeriod:  *resyncPeriod,
 		Ep:            &endpoint,
 		StopChan:      stopChan,
+
+		UseEndpointSlices: *useEndpointSlices,
+		DrainTimeout:      *drainTimeout,
+		ReconcilePeriod:   *reconcilePeriod,
+		IngressController: *ingressController,
+
+		IngressClassAnnotation: *ingressClassAnnotation,
+		TLSCertDir:             *tlsCertDir,
+		DefaultSSLCertificate:  *defaultSSLCertificate,
+		SSLRedirect:            *sslRedirect,
+		Snippets:               *snippets,
+	}
+
+	if *snippetNamespaces != namespace.ALL {
+		watcher.SnippetNamespaces = make(map[string]bool)
+		for _, namespace := range strings.Split(strings.ReplaceAll(strings.ToLower(*snippetNamespaces), " ", ""), ",") {
+			if namespace != "" {
+				watcher.SnippetNamespaces[namespace] = true
+			}
+		}
+	}
+
+	if *publishService != "" && len(strings.Split(*publishService, "/")) != 2 {
+		log.Panicln("publishService must be namespace/name.")
+	}
+	if *defaultSSLCertificate != "" && len(strings.Split(*defaultSSLCertificate, "/")) != 2 {
+		log.Panicln("defaultSSLCertificate must be namespace/name.")
+	}
+	for _, address := range strings.Split(strings.ReplaceAll(*publishStatusAddress, " ", ""), ",") {
+		if address != "" {
+			watcher.PublishStatusAddresses = append(watcher.PublishStatusAddresses, address)
+		}
+	}
+	watcher.PublishService = *publishService
+
+	ctx, cancel := context.WithCancel(context.Background())
+	electionDone := make(chan struct{})
+	if *leaderElect {
+		if *leaseNamespace == "" {
+			*leaseNamespace = *atsNamespace
+		}
+		watcher.Leader = &w.Leadership{}
+		go func() {
+			defer close(electionDone)
+			runLeaderElection(ctx, clientset, watcher.Leader, *leaseNamespace, *leaseName)
+		}()
+	} else {
+		close(electionDone)
 	}
 
 	err = watcher.Watch()
@@ -170,10 +244,62 @@ func main() {
 
 	/* Program termination */
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	for range signalChan {
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signalChan {
+		if sig == syscall.SIGHUP {
+			log.Println("Reconcile signal received")
+			watcher.Reconcile()
+			continue
+		}
 		log.Println("Shutdown signal received, exiting...")
 		close(stopChan)
+		// let the leader release its Lease
+		cancel()
+		<-electionDone
 		os.Exit(0)
 	}
 }
+
+// runLeaderElection campaigns for the Lease until ctx is done, recording in
+// leadership whether this replica holds it. Losing the Lease only stops the
+// cluster-scoped writes, so the replica runs for it again.
+func runLeaderElection(ctx context.Context, clientset kubernetes.Interface, leadership *w.Leadership, namespace, name string) {
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Client: clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) {
+					log.Printf("Started leading as %s", identity)
+					leadership.SetLeading(true)
+				},
+				OnStoppedLeading: func() {
+					log.Printf("Stopped leading as %s", identity)
+					leadership.SetLeading(false)
+				},
+				OnNewLeader: func(leader string) {
+					log.Printf("Lease %s/%s is held by %s", namespace, name, leader)
+				},
+			},
+		})
+	}
+}
@@ -24,6 +24,15 @@ local client = redis.connect('unix:///opt/ats/var/run/redis/redis.sock')
 
 local snippet_enabled = false
 
+-- routing tables are published to DB 2 in generations. A request only
+-- reads the generation that was active when it started.
+local generation = nil
+
+-- state of the round-robin and least-requests algorithms. Each Lua state
+-- of ATS balances the requests it routes on its own.
+local round_robin = {}
+local in_flight = {}
+
 function __init__(argtb)
   if (#argtb) > 0 then
     ts.debug("Parameter is given. Snippet is enabled.")
@@ -42,18 +51,31 @@ function ipport_split(s, delimiter)
   return result
 end
 
+-- helper function to get the key of a DB 0 or DB 1 entry in the generation.
+-- An entry is only published again when it changes, so its key is the one
+-- of the version it had in the generation, the previous one if it changed
+-- since.
+function generation_key(db, key)
+  local versions = client:hmget(db .. "/" .. key, 'version', 'previous') -- redis blocking call
+  local version = versions[1]
+  if version ~= nil and tonumber(version) > tonumber(generation) then
+    version = versions[2]
+  end
+  -- no generation 0 is ever published
+  return (version or 0) .. "/" .. db .. "/" .. key
+end
+
 function check_path_exact_match(req_scheme, req_host, req_path)
   local host_path = "E+"..req_scheme .. "://" .. req_host .. req_path
   ts.debug('checking host_path: '..host_path)
-  client:select(1) -- go with hostpath table first
-  return client:smembers(host_path) -- redis blocking call
+  -- go with hostpath table first
+  return client:smembers(generation_key(1, host_path)) -- redis blocking call
 end
 
 function check_path_prefix_match(req_scheme, req_host, req_path)
   local host_path = "P+"..req_scheme .. "://" .. req_host .. req_path
   ts.debug('checking host_path: '..host_path)
-  client:select(1)
-  local svcs = client:smembers(host_path) -- redis blocking call
+  local svcs = client:smembers(generation_key(1, host_path)) -- redis blocking call
 
   if (svcs ~= nil and #svcs > 0) then
     return svcs
@@ -74,8 +96,7 @@ function check_path_prefix_match(req_scheme, req_host, req_path)
 
     host_path = "P+"..req_scheme .. "://" .. req_host .. subpath
     ts.debug('checking host_path: '..host_path)
-    client:select(1)
-    svcs =client:smembers(host_path) -- redis blocking call
+    svcs = client:smembers(generation_key(1, host_path)) -- redis blocking call
     if (svcs ~= nil and #svcs > 0) then
       return svcs
     end
@@ -85,8 +106,7 @@ function check_path_prefix_match(req_scheme, req_host, req_path)
 
       host_path = "P+"..req_scheme .. "://" .. req_host .. subpath
       ts.debug('checking host_path: '..host_path)
-      client:select(1)
-      svcs = client:smembers(host_path) -- redis blocking call
+      svcs = client:smembers(generation_key(1, host_path)) -- redis blocking call
       if (svcs ~= nil and #svcs > 0) then
         return svcs
       end
@@ -104,6 +124,432 @@ function get_wildcard_domain(req_host)
   return "*" .. string.sub (req_host, pos)
 end
 
+-- helper function to collect the "@namespace/name/option=value" members of
+-- a host/path. An option set by several Ingresses is the one of the Ingress
+-- whose namespace/name sorts first.
+function route_options(svcs)
+  local owned = {}
+  local owners = {}
+  for _, svc in ipairs(svcs) do
+    local owner, option, value = string.match(svc, "^@([^/]*/[^/]*)/([^=]*)=(.*)$")
+    if owner ~= nil then
+      if owned[owner] == nil then
+        owned[owner] = {}
+        table.insert(owners, owner)
+      end
+      owned[owner][option] = value
+    end
+  end
+  table.sort(owners)
+
+  local options = {}
+  for _, owner in ipairs(owners) do
+    for option, value in pairs(owned[owner]) do
+      if options[option] == nil then
+        options[option] = value
+      end
+    end
+  end
+  return options
+end
+
+-- answers a plain http request with a permanent redirect to https
+function ssl_redirect(req_host, req_path)
+  local location = "https://" .. req_host .. req_path
+  local query = ts.client_request.get_uri_args()
+  if (query ~= nil and query ~= '') then
+    location = location .. "?" .. query
+  end
+  ts.debug("redirecting to " .. location)
+
+  ts.http.set_resp(308, "")
+  ts.hook(TS_LUA_HOOK_SEND_RESPONSE_HDR, function()
+    ts.client_response.header['Location'] = location
+  end)
+end
+
+-- applies the rewrite-target or strip-prefix option of a route to the path
+-- forwarded. $1 to $9 of the target are the captures of the rewrite-pattern.
+function rewrite_path(req_path, options)
+  local target = options['rewrite-target']
+  local pattern = options['rewrite-pattern']
+  if (target ~= nil and pattern ~= nil) then
+    local replacement = string.gsub(string.gsub(target, "%%", "%%%%"), "%$(%d)", "%%%1")
+    local ok, path, count = pcall(string.gsub, req_path, pattern, replacement, 1)
+    if not ok then
+      ts.error("Rewrite Failure: " .. path)
+      return req_path
+    end
+    if count > 0 then
+      if string.sub(path, 1, 1) ~= "/" then
+        path = "/" .. path
+      end
+      return path
+    end
+    return req_path
+  end
+
+  local prefix = options['strip-prefix']
+  if (prefix ~= nil and string.sub(req_path, 1, #prefix) == prefix) then
+    local path = string.sub(req_path, #prefix + 1)
+    if string.sub(path, 1, 1) ~= "/" then
+      path = "/" .. path
+    end
+    return path
+  end
+
+  return req_path
+end
+
+-- helper function to hash a string into a number, the same for every request
+function hash(s)
+  local h = 5381
+  for i = 1, #s do
+    h = (h * 33 + string.byte(s, i)) % 4294967296
+  end
+  return h
+end
+
+-- helper function to get the value of a cookie of a request
+function cookie_value(cookies, name)
+  if cookies == nil then
+    return nil
+  end
+  for pair in string.gmatch(cookies, "[^;]+") do
+    local k, v = string.match(pair, "^%s*(.-)%s*=%s*(.-)%s*$")
+    if k == name then
+      return v
+    end
+  end
+  return nil
+end
+
+-- tells if a request goes to the canary backend of a route. The header and
+-- cookie say so first, with "always" or "never", then the canary-weight
+-- percent of the clients, picked by the hash of their address, do.
+function use_canary(options)
+  if options['canary-backend'] == nil then
+    return false
+  end
+
+  local header = options['canary-by-header']
+  if header ~= nil then
+    local value = ts.client_request.header[header]
+    local expected = options['canary-by-header-value']
+    if expected ~= nil then
+      if value == expected then
+        return true
+      end
+    elseif value == 'always' then
+      return true
+    elseif value == 'never' then
+      return false
+    end
+  end
+
+  local cookie = options['canary-by-cookie']
+  if cookie ~= nil then
+    local value = cookie_value(ts.client_request.header['Cookie'], cookie)
+    if value == 'always' then
+      return true
+    elseif value == 'never' then
+      return false
+    end
+  end
+
+  local weight = tonumber(options['canary-weight']) or 0
+  if weight <= 0 then
+    return false
+  elseif weight >= 100 then
+    return true
+  end
+  local addr = ts.client_request.client_addr.get_addr() or ''
+  return hash(addr) % 100 < weight
+end
+
+-- helper function to get the key of the consistent-hash algorithm
+function upstream_hash_key(hash_by)
+  local kind, name = string.match(hash_by or '', "^(%a+):(.+)$")
+  if kind == 'header' then
+    return ts.client_request.header[name] or ''
+  elseif kind == 'cookie' then
+    return cookie_value(ts.client_request.header['Cookie'], name) or ''
+  end
+  return ts.client_request.client_addr.get_addr() or ''
+end
+
+-- picks the endpoint of a svc with the load-balance algorithm of a route.
+-- txn remembers the endpoint a transaction is counted against under
+-- least-requests, which it stops being once another one is picked.
+function pick_endpoint(svc, options, txn)
+  local algorithm = options['load-balance']
+  if algorithm == nil or algorithm == 'random' then
+    return client:srandmember(generation_key(0, svc)) -- redis blocking call
+  end
+
+  local ipports = client:smembers(generation_key(0, svc)) -- redis blocking call
+  if (ipports == nil or #ipports == 0) then
+    return nil
+  end
+  table.sort(ipports)
+
+  if algorithm == 'round-robin' then
+    local count = (round_robin[svc] or 0) + 1
+    round_robin[svc] = count
+    return ipports[(count - 1) % #ipports + 1]
+  elseif algorithm == 'least-requests' then
+    local picked = ipports[1]
+    for _, ipport in ipairs(ipports) do
+      if (in_flight[ipport] or 0) < (in_flight[picked] or 0) then
+        picked = ipport
+      end
+    end
+    if txn.endpoint ~= nil then
+      in_flight[txn.endpoint] = in_flight[txn.endpoint] - 1
+    else
+      ts.hook(TS_LUA_HOOK_TXN_CLOSE, function()
+        in_flight[txn.endpoint] = in_flight[txn.endpoint] - 1
+      end)
+    end
+    in_flight[picked] = (in_flight[picked] or 0) + 1
+    txn.endpoint = picked
+    return picked
+  elseif algorithm == 'consistent-hash' then
+    -- rendezvous hashing moves only the keys of the endpoints changing
+    local key = upstream_hash_key(options['upstream-hash-by'])
+    local picked, highest = nil, -1
+    for _, ipport in ipairs(ipports) do
+      local weight = hash(key .. '#' .. ipport)
+      if weight > highest then
+        picked, highest = ipport, weight
+      end
+    end
+    return picked
+  end
+
+  ts.error("Unknown load-balance algorithm: " .. algorithm)
+  return ipports[1]
+end
+
+-- configures the connection to a backend speaking protocol and returns the
+-- scheme of the url to it. HTTP/2 is negotiated with ALPN over TLS, by the
+-- ATS versions allowing it per transaction. ATS speaks no HTTP/2 to the
+-- backends in clear text, so h2c and grpc backends get HTTP/1.1.
+function backend_scheme(protocol)
+  local scheme = 'http'
+  if (protocol == 'https' or protocol == 'grpcs') then
+    scheme = 'https'
+  end
+
+  if (protocol == 'h2c' or protocol == 'grpc' or protocol == 'grpcs') then
+    if (scheme == 'https' and TS_LUA_CONFIG_SSL_CLIENT_ALPN_PROTOCOLS ~= nil) then
+      -- gRPC only runs over HTTP/2
+      local alpn = 'h2'
+      if protocol ~= 'grpcs' then
+        alpn = 'h2,http/1.1'
+      end
+      ts.http.config_string_set(TS_LUA_CONFIG_SSL_CLIENT_ALPN_PROTOCOLS, alpn)
+    else
+      ts.debug("HTTP/2 to the backend is not supported, using HTTP/1.1 for " .. protocol)
+    end
+  end
+
+  return scheme
+end
+
+-- configures the verification of the certificate of an https backend, and
+-- the client certificate presented to it
+function upstream_tls(options)
+  local name = options['proxy-ssl-name']
+  if name ~= nil then
+    -- the name is sent as SNI, which ATS takes from the Host header when
+    -- connecting, so the Host of the client is given back once connected
+    local host = ts.client_request.header['Host']
+    ts.http.config_string_set(TS_LUA_CONFIG_SSL_CLIENT_SNI_POLICY, 'host')
+    ts.client_request.header['Host'] = name
+    ts.hook(TS_LUA_HOOK_SEND_REQUEST_HDR, function()
+      ts.client_request.header['Host'] = host
+      ts.server_request.header['Host'] = host
+    end)
+  end
+
+  local ca = options['proxy-ssl-ca']
+  if ca ~= nil then
+    ts.http.config_string_set(TS_LUA_CONFIG_SSL_CLIENT_CA_CERT_FILENAME, ca)
+    ts.http.config_string_set(TS_LUA_CONFIG_SSL_CLIENT_VERIFY_SERVER_POLICY, 'ENFORCED')
+    if name ~= nil then
+      ts.http.config_string_set(TS_LUA_CONFIG_SSL_CLIENT_VERIFY_SERVER_PROPERTIES, 'ALL')
+    else
+      ts.http.config_string_set(TS_LUA_CONFIG_SSL_CLIENT_VERIFY_SERVER_PROPERTIES, 'SIGNATURE')
+    end
+  end
+
+  local cert = options['proxy-ssl-cert']
+  local key = options['proxy-ssl-key']
+  if (cert ~= nil and key ~= nil) then
+    ts.http.config_string_set(TS_LUA_CONFIG_SSL_CLIENT_CERT_FILENAME, cert)
+    ts.http.config_string_set(TS_LUA_CONFIG_SSL_CLIENT_PRIVATE_KEY_FILENAME, key)
+  end
+end
+
+-- applies the timeouts and retries of a route to the transaction
+function upstream_policy(svc, options, txn, scheme, path)
+  local connect_timeout = tonumber(options['connect-timeout'])
+  if connect_timeout ~= nil then
+    ts.http.config_int_set(TS_LUA_CONFIG_HTTP_CONNECT_ATTEMPTS_TIMEOUT, connect_timeout)
+  end
+
+  local read_timeout = tonumber(options['read-timeout'])
+  if read_timeout ~= nil then
+    ts.http.config_int_set(TS_LUA_CONFIG_HTTP_TRANSACTION_NO_ACTIVITY_TIMEOUT_OUT, read_timeout)
+  end
+
+  local retries = tonumber(options['retries'])
+  if retries == nil then
+    return
+  end
+
+  local on_connect_failure = false
+  local on_5xx = false
+  for condition in string.gmatch(options['retry-on'] or 'connect-failure', '[^,]+') do
+    if condition == 'connect-failure' then
+      on_connect_failure = true
+    elseif condition == '5xx' then
+      on_5xx = true
+    end
+  end
+
+  if on_connect_failure then
+    ts.http.config_int_set(TS_LUA_CONFIG_HTTP_CONNECT_ATTEMPTS_MAX_RETRIES, retries)
+  else
+    ts.http.config_int_set(TS_LUA_CONFIG_HTTP_CONNECT_ATTEMPTS_MAX_RETRIES, 0)
+  end
+
+  -- requests with a body cannot be replayed, and redirects are sent with
+  -- the address of the endpoint as SNI
+  local method = ts.client_request.get_method()
+  if (not on_5xx or retries == 0 or (method ~= 'GET' and method ~= 'HEAD') or options['proxy-ssl-name'] ~= nil) then
+    return
+  end
+
+  -- ATS follows the redirect to another endpoint within the transaction
+  local attempts = 0
+  local host = nil
+  ts.hook(TS_LUA_HOOK_READ_RESPONSE_HDR, function()
+    local status = ts.server_response.get_status()
+    if (status < 500 or attempts >= retries) then
+      if attempts > 0 then
+        -- the redirects of the backends are passed on to the client
+        ts.http.config_int_set(TS_LUA_CONFIG_HTTP_NUMBER_OF_REDIRECTIONS, 0)
+      end
+      return
+    end
+
+    local ipport = pick_endpoint(svc, options, txn)
+    if ipport == nil then
+      return
+    end
+    if attempts == 0 then
+      -- ATS sends the address of the endpoint as Host when redirecting
+      host = ts.client_request.header['Host']
+      ts.hook(TS_LUA_HOOK_SEND_REQUEST_HDR, function()
+        ts.server_request.header['Host'] = host
+      end)
+    end
+    attempts = attempts + 1
+
+    local values = ipport_split(ipport, '#')
+    local url = scheme .. "://" .. values[1] .. ":" .. values[2] .. path
+    local query = ts.client_request.get_uri_args()
+    if (query ~= nil and query ~= '') then
+      url = url .. "?" .. query
+    end
+    ts.debug("retrying after " .. status .. " with " .. url)
+    ts.http.config_int_set(TS_LUA_CONFIG_HTTP_NUMBER_OF_REDIRECTIONS, 1)
+    ts.http.redirect_url_set(url)
+  end)
+end
+
+function header_value(value, variables)
+  return (string.gsub(value, '%$([%a_]+)', function(name)
+    local variable = variables[name]
+    if variable ~= nil then
+      return variable()
+    end
+  end))
+end
+
+-- removes, sets and appends to headers as the route options of kind
+-- 'request' or 'response' say
+function apply_headers(headers, kind, options, variables)
+  for option, _ in pairs(options) do
+    local name = string.match(option, '^' .. kind .. '%-header%-remove:(.+)$')
+    if name ~= nil then
+      headers[name] = nil
+    end
+  end
+
+  for option, value in pairs(options) do
+    local name = string.match(option, '^' .. kind .. '%-header%-set:(.+)$')
+    if name ~= nil then
+      headers[name] = header_value(value, variables)
+    end
+  end
+
+  for option, value in pairs(options) do
+    local name = string.match(option, '^' .. kind .. '%-header%-append:(.+)$')
+    if name ~= nil then
+      local current = headers[name]
+      if (current ~= nil and current ~= '') then
+        headers[name] = current .. ", " .. header_value(value, variables)
+      else
+        headers[name] = header_value(value, variables)
+      end
+    end
+  end
+end
+
+-- applies the headers of a route to the request, and to the response once
+-- it is sent
+function route_headers(options, req_host)
+  local request_headers = false
+  local response_headers = false
+  for option, _ in pairs(options) do
+    if string.match(option, '^request%-header%-') then
+      request_headers = true
+    elseif string.match(option, '^response%-header%-') then
+      response_headers = true
+    end
+  end
+
+  local request_id = nil
+  local variables = {
+    client_ip = function()
+      return (ts.client_request.client_addr.get_addr())
+    end,
+    host = function()
+      return req_host
+    end,
+    -- the same id is given to the request and its response
+    request_id = function()
+      if request_id == nil then
+        request_id = ts.client_request.header['X-Request-ID'] or tostring(ts.http.id())
+      end
+      return request_id
+    end,
+  }
+
+  if request_headers then
+    apply_headers(ts.client_request.header, 'request', options, variables)
+  end
+
+  if response_headers then
+    ts.hook(TS_LUA_HOOK_SEND_RESPONSE_HDR, function()
+      apply_headers(ts.client_response.header, 'response', options, variables)
+    end)
+  end
+end
+
 function cache_lookup()
   local cache = ts.http.get_cache_lookup_url()
 
@@ -126,6 +572,13 @@ function do_global_read_request()
     ts.debug("In 'not response: '", response)
     return 0
   end
+
+  client:select(2)
+  generation = client:get('generation')
+  if generation == nil then
+    ts.error("Redis Lookup Failure: no generation of the routing tables")
+    return 0
+  end
   
   -- We only care about host, path, and port#
   local req_scheme = ts.client_request.get_url_scheme() or 'http'
@@ -187,15 +640,30 @@ function do_global_read_request()
     return 0
   end
 
-  for _, svc in ipairs(svcs) do
+  local options = route_options(svcs)
+
+  if (options['ssl-redirect'] == 'true' and req_scheme == 'http') then
+    ssl_redirect(req_host, req_path)
+    return 0
+  end
+
+  local backends = svcs
+  if use_canary(options) then
+    ts.debug("routing to canary")
+    backends = {options['canary-backend']}
+  end
+
+  for _, svc in ipairs(backends) do
     if svc == nil then
       ts.error("Redis Lookup Failure: svc == nil for hostpath")
       return 0
     end
-    if string.sub(svc, 1, 1) ~= "$" then
+    local kind = string.sub(svc, 1, 1)
+    if kind ~= "$" and kind ~= "@" then
       ts.debug("routing")
-      client:select(0) -- go with svc table second
-      local ipport = client:srandmember(svc) -- redis blocking call
+      -- go with svc table second
+      local txn = {}
+      local ipport = pick_endpoint(svc, options, txn)
       -- svc not in redis DB
       if ipport == nil then
         ts.error("Redis Lookup Failure: ipport == nil for svc")
@@ -214,8 +682,15 @@ function do_global_read_request()
       ts.http.set_cache_url(url)
 
       ts.http.skip_remapping_set(1)
-      ts.client_request.set_url_scheme(values[3])
-      ts.client_request.set_uri(req_path)
+      local scheme = backend_scheme(options['backend-protocol'] or values[3])
+      ts.client_request.set_url_scheme(scheme)
+      local path = rewrite_path(req_path, options)
+      ts.client_request.set_uri(path)
+      upstream_policy(svc, options, txn, scheme, path)
+      route_headers(options, req_host)
+      if scheme == 'https' then
+        upstream_tls(options)
+      end
       ts.client_request.set_url_host(values[1])
       ts.client_request.set_url_port(values[2])
       
@@ -230,8 +705,7 @@ function do_global_read_request()
       end
       if string.sub(svc, 1, 1) == "$" then
         ts.debug("snippet")
-        client:select(1)
-        local snippets = client:smembers(svc)
+        local snippets = client:smembers(generation_key(1, svc))
 
         if snippets == nil then
           ts.error("Redis Lookup Failure: snippets == nil for hostpath")
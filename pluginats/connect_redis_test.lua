@@ -14,8 +14,8 @@
 --  See the License for the specific language governing permissions and
 --  limitations under the License.
 
-_G.ts = { client_request = {}, http = {} }
-_G.client = {dbone = {}, dbdefault = {}, selecteddb = 0}
+_G.ts = { client_request = {}, server_request = {}, server_response = {}, client_response = {}, http = {} }
+_G.client = {dbone = {}, dbdefault = {}, dbtwo = {}, selecteddb = 0}
 _G.TS_LUA_REMAP_DID_REMAP = 1
 
 function ts.client_request.get_url_scheme()
@@ -38,21 +38,35 @@ function connect(path)
 end
 
 function client.select(self, number)
-  if number == 1 then
+  if number == 2 then
+    self.selecteddb = 2
+  elseif number == 1 then
     self.selecteddb = 1
   elseif number == 0 then
     self.selecteddb = 0
   end
 end
 
-function client.sadd(self, key, ...)
-  db = nil
-  if self.selecteddb == 1 then 
-    db = self.dbone
-  elseif self.selecteddb == 0 then
-    db = self.dbdefault
+function client.selected(self)
+  if self.selecteddb == 2 then
+    return self.dbtwo
+  elseif self.selecteddb == 1 then
+    return self.dbone
   end
-  
+  return self.dbdefault
+end
+
+function client.set(self, key, value)
+  self:selected()[key] = value
+end
+
+function client.get(self, key)
+  return self:selected()[key]
+end
+
+function client.sadd(self, key, ...)
+  db = self:selected()
+
   if type(db[key]) ~= "table" then
     db[key] = {}
   end
@@ -63,31 +77,44 @@ function client.sadd(self, key, ...)
   end
 end
 
+function client.hset(self, key, field, value)
+  db = self:selected()
+
+  if type(db[key]) ~= "table" then
+    db[key] = {}
+  end
+  db[key][field] = value
+end
+
+function client.hmget(self, key, ...)
+  local hash = self:selected()[key] or {}
+  local values = {}
+  for i=1,select('#',...) do
+    values[i] = hash[select(i,...)]
+  end
+  return values
+end
+
+-- publishes a DB 0 or DB 1 entry in the first generation
+function client.publish(self, db, key, ...)
+  self:sadd("1/" .. db .. "/" .. key, ...)
+  self:hset(db .. "/" .. key, "version", "1")
+end
+
 function client.ping()
   return "PONG"
 end
 
 function client.smembers(self, key)
-  db = nil
-  if self.selecteddb == 1 then 
-    db = self.dbone
-  elseif self.selecteddb == 0 then
-    db = self.dbdefault
-  end
-
-  return db[key]
+  return self:selected()[key]
 end
 
 function client.srandmember(self, key)
-  idx = math.random(1,2)
-  db = nil
-  if self.selecteddb == 1 then 
-    db = self.dbone
-  elseif self.selecteddb == 0 then
-    db = self.dbdefault
+  local members = self:selected()[key]
+  if members == nil then
+    return nil
   end
-  
-  return db[key][idx]
+  return members[math.random(1,#members)]
 end
   
 
@@ -107,10 +134,10 @@ describe("Unit tests - Lua", function()
 
       client = redis.connect()
 
-      client:select(1)
-      client:sadd("E+http://test.edge.com/app1","trafficserver-test-2:appsvc1:8080")
-      client:select(0)
-      client:sadd("trafficserver-test-2:appsvc1:8080","172.17.0.3#8080#http","172.17.0.5#8080#http")
+      client:select(2)
+      client:set("generation","1")
+      client:publish(1, "E+http://test.edge.com/app1","trafficserver-test-2:appsvc1:8080")
+      client:publish(0, "trafficserver-test-2:appsvc1:8080","172.17.0.3#8080#http","172.17.0.5#8080#http")
       --require 'pl.pretty'.dump(client)
 
       stub(ts, "add_package_cpath")
@@ -181,10 +208,10 @@ describe("Unit tests - Lua", function()
     end)
 
     it("Test - Snippet", function()
-      client:select(1)
-      client:sadd("E+http://test.edge.com/app1","$trafficserver-test-3/app-ingress/411990")
+      client:select(2)
+      client:publish(1, "E+http://test.edge.com/app1","$trafficserver-test-3/app-ingress/411990")
       snippet = "ts.debug('Debug msg example')\nts.error('Error msg example')\n-- ts.hook(TS_LUA_HOOK_SEND_RESPONSE_HDR, function()\n--   ts.client_response.header['Location'] = 'https://test.edge.com/app2'\n-- end)\nts.http.skip_remapping_set(0)\nts.http.set_resp(301, 'Redirect')\nts.debug('Uncomment the above lines to redirect http request to https')\nts.debug('Modification for testing')\n"
-      client:sadd("$trafficserver-test-3/app-ingress/411990",snippet) 
+      client:publish(1, "$trafficserver-test-3/app-ingress/411990",snippet) 
       
       --require 'pl.pretty'.dump(client)
       require "connect_redis"
@@ -197,6 +224,345 @@ describe("Unit tests - Lua", function()
       assert.stub(ts.http.set_resp).was.called_with(301,"Redirect")
     end)
 
+    it("Test - No generation published", function()
+      client:select(2)
+      client:set("generation",nil)
+
+      require "connect_redis"
+      local result = do_global_read_request()
+
+      assert.are.equal(0, result)
+      assert.stub(ts.error).was.called_with("Redis Lookup Failure: no generation of the routing tables")
+
+      client:select(2)
+      client:set("generation","1")
+    end)
+
+    it("Test - Entry published again in a later generation", function()
+      client:select(2)
+      client:publish(1, "E+http://version.edge.com/app1","trafficserver-test-2:appsvc1:8080")
+      client:sadd("2/1/E+http://version.edge.com/app1","trafficserver-test-2:appsvc2:8080")
+      client:hset("1/E+http://version.edge.com/app1","version","2")
+      client:hset("1/E+http://version.edge.com/app1","previous","1")
+
+      stub(ts.client_request, "get_url_host").returns("version.edge.com")
+      stub(ts.client_request, "set_url_port")
+
+      require "connect_redis"
+      do_global_read_request()
+
+      -- the request still reads generation 1
+      assert.stub(ts.client_request.set_url_port).was.called_with("8080")
+      assert.are.equal("1/1/E+http://version.edge.com/app1", generation_key(1, "E+http://version.edge.com/app1"))
+
+      client:set("generation","2")
+      do_global_read_request()
+      assert.are.equal("2/1/E+http://version.edge.com/app1", generation_key(1, "E+http://version.edge.com/app1"))
+      client:set("generation","1")
+    end)
+
+    it("Test - SSL redirect", function()
+      client:select(2)
+      client:publish(1, "E+http://secure.edge.com/app1","@trafficserver-test-2/app/ssl-redirect=true")
+      client:publish(1, "E+https://secure.edge.com/app1","trafficserver-test-2:appsvc1:8080")
+
+      stub(ts.client_request, "get_url_host").returns("secure.edge.com")
+      stub(ts.client_request, "get_uri_args").returns("a=1")
+      stub(ts.client_request, "set_url_port")
+      stub(ts.http, "set_resp")
+      stub(ts, "hook")
+
+      require "connect_redis"
+      local result = do_global_read_request()
+
+      assert.are.equal(0, result)
+      assert.stub(ts.http.set_resp).was.called_with(308, "")
+      assert.stub(ts.hook).was.called_with(TS_LUA_HOOK_SEND_RESPONSE_HDR, match._)
+      assert.stub(ts.client_request.set_url_port).was_not.called()
+    end)
+
+    it("Test - Options of several Ingresses", function()
+      client:select(2)
+      client:publish(1, "E+http://shared.edge.com/app1","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/b/strip-prefix=/app1","@trafficserver-test-2/b/rewrite-pattern=^/app1/?(.*)","@trafficserver-test-2/a/strip-prefix=/")
+
+      local options = route_options(client:smembers("1/1/E+http://shared.edge.com/app1"))
+
+      -- the option set by both is the one of the Ingress sorting first
+      assert.are.equal("/", options['strip-prefix'])
+      assert.are.equal("^/app1/?(.*)", options['rewrite-pattern'])
+    end)
+
+    it("Test - Rewrite target", function()
+      client:select(2)
+      client:publish(1, "P+http://rewrite.edge.com/team/app","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app/rewrite-pattern=^/team/app/?(.*)","@trafficserver-test-2/app/rewrite-target=/$1")
+
+      stub(ts.client_request, "get_url_host").returns("rewrite.edge.com")
+      stub(ts.client_request, "get_uri").returns("/team/app/users/1")
+      stub(ts.client_request, "set_uri")
+
+      require "connect_redis"
+      do_global_read_request()
+
+      assert.stub(ts.client_request.set_uri).was.called_with("/users/1")
+    end)
+
+    it("Test - Strip prefix", function()
+      client:select(2)
+      client:publish(1, "P+http://strip.edge.com/team/app","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app/strip-prefix=/team/app")
+
+      stub(ts.client_request, "get_url_host").returns("strip.edge.com")
+      stub(ts.client_request, "get_uri").returns("/team/app")
+      stub(ts.client_request, "set_uri")
+
+      require "connect_redis"
+      do_global_read_request()
+
+      assert.stub(ts.client_request.set_uri).was.called_with("/")
+    end)
+
+    it("Test - Canary by header", function()
+      client:select(2)
+      client:publish(1, "E+http://canary.edge.com/app1","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app-canary/canary-backend=trafficserver-test-2:appsvc2:8080","@trafficserver-test-2/app-canary/canary-by-header=X-Canary","@trafficserver-test-2/app-canary/canary-weight=0")
+      client:publish(0, "trafficserver-test-2:appsvc2:8080","172.17.0.7#8080#http","172.17.0.7#8080#http")
+
+      stub(ts.client_request, "get_url_host").returns("canary.edge.com")
+      stub(ts.client_request, "get_uri").returns("/app1")
+      stub(ts.client_request, "set_url_host")
+      ts.client_request.header = {['X-Canary'] = 'always'}
+
+      require "connect_redis"
+      do_global_read_request()
+
+      assert.stub(ts.client_request.set_url_host).was.called_with("172.17.0.7")
+    end)
+
+    it("Test - Canary by weight", function()
+      client:select(2)
+      client:publish(1, "E+http://weight.edge.com/app1","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app-canary/canary-backend=trafficserver-test-2:appsvc2:8080","@trafficserver-test-2/app-canary/canary-weight=100")
+
+      stub(ts.client_request, "get_url_host").returns("weight.edge.com")
+      stub(ts.client_request, "get_uri").returns("/app1")
+      stub(ts.client_request, "set_url_host")
+      ts.client_request.header = {}
+      ts.client_request.client_addr = {}
+      stub(ts.client_request.client_addr, "get_addr").returns("10.0.0.1")
+
+      require "connect_redis"
+      do_global_read_request()
+
+      assert.stub(ts.client_request.set_url_host).was.called_with("172.17.0.7")
+    end)
+
+    it("Test - Round robin", function()
+      client:select(2)
+      client:publish(1, "E+http://rr.edge.com/app1","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app/load-balance=round-robin")
+
+      stub(ts.client_request, "get_url_host").returns("rr.edge.com")
+      stub(ts.client_request, "get_uri").returns("/app1")
+      stub(ts.client_request, "set_url_host")
+
+      require "connect_redis"
+      do_global_read_request()
+      do_global_read_request()
+
+      assert.stub(ts.client_request.set_url_host).was.called_with("172.17.0.3")
+      assert.stub(ts.client_request.set_url_host).was.called_with("172.17.0.5")
+    end)
+
+    it("Test - Consistent hash", function()
+      client:select(2)
+      client:publish(1, "E+http://hash.edge.com/app1","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app/load-balance=consistent-hash","@trafficserver-test-2/app/upstream-hash-by=header:X-User")
+
+      stub(ts.client_request, "get_url_host").returns("hash.edge.com")
+      stub(ts.client_request, "get_uri").returns("/app1")
+      ts.client_request.header = {['X-User'] = 'alice'}
+
+      require "connect_redis"
+      local options = route_options(client:smembers("1/1/E+http://hash.edge.com/app1"))
+      local picked = ipport_split(pick_endpoint("trafficserver-test-2:appsvc1:8080", options, {}), '#')[1]
+
+      for i = 1, 5 do
+        stub(ts.client_request, "set_url_host")
+        do_global_read_request()
+        assert.stub(ts.client_request.set_url_host).was.called_with(picked)
+      end
+    end)
+
+    it("Test - Backend protocol", function()
+      client:select(2)
+      client:publish(1, "E+http://grpc.edge.com/app1","trafficserver-test-2:grpcsvc:8443")
+      client:publish(0, "trafficserver-test-2:grpcsvc:8443","172.17.0.9#8443#grpcs")
+      client:publish(1, "E+http://tls.edge.com/app1","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app/backend-protocol=https")
+      client:publish(1, "E+http://h2c.edge.com/app1","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app/backend-protocol=h2c")
+
+      stub(ts.client_request, "get_uri").returns("/app1")
+      stub(ts.client_request, "set_url_scheme")
+      stub(ts.http, "config_string_set")
+      _G.TS_LUA_CONFIG_SSL_CLIENT_ALPN_PROTOCOLS = "TS_LUA_CONFIG_SSL_CLIENT_ALPN_PROTOCOLS"
+
+      require "connect_redis"
+      stub(ts.client_request, "get_url_host").returns("grpc.edge.com")
+      do_global_read_request()
+
+      assert.stub(ts.client_request.set_url_scheme).was.called_with("https")
+      assert.stub(ts.http.config_string_set).was.called_with(TS_LUA_CONFIG_SSL_CLIENT_ALPN_PROTOCOLS, "h2")
+
+      stub(ts.client_request, "set_url_scheme")
+      stub(ts.http, "config_string_set")
+      stub(ts.client_request, "get_url_host").returns("tls.edge.com")
+      do_global_read_request()
+
+      assert.stub(ts.client_request.set_url_scheme).was.called_with("https")
+      assert.stub(ts.http.config_string_set).was_not.called()
+
+      -- HTTP/2 in clear text falls back to HTTP/1.1
+      stub(ts.client_request, "set_url_scheme")
+      stub(ts.client_request, "get_url_host").returns("h2c.edge.com")
+      do_global_read_request()
+
+      assert.stub(ts.client_request.set_url_scheme).was.called_with("http")
+      assert.stub(ts.http.config_string_set).was_not.called()
+      _G.TS_LUA_CONFIG_SSL_CLIENT_ALPN_PROTOCOLS = nil
+    end)
+
+    it("Test - Upstream TLS", function()
+      client:select(2)
+      client:publish(1, "E+http://verify.edge.com/app1","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app/backend-protocol=https","@trafficserver-test-2/app/proxy-ssl-ca=/certs/trafficserver-test-2_ca_ca.crt","@trafficserver-test-2/app/proxy-ssl-name=appsvc1.internal")
+
+      stub(ts.client_request, "get_url_host").returns("verify.edge.com")
+      stub(ts.client_request, "get_uri").returns("/app1")
+      stub(ts.http, "config_string_set")
+      ts.client_request.header = {['Host'] = 'verify.edge.com'}
+      ts.server_request.header = {['Host'] = 'appsvc1.internal'}
+      local send_request
+      ts.hook = function(id, f)
+        if id == TS_LUA_HOOK_SEND_REQUEST_HDR then send_request = f end
+      end
+      _G.TS_LUA_HOOK_SEND_REQUEST_HDR = "TS_LUA_HOOK_SEND_REQUEST_HDR"
+      _G.TS_LUA_CONFIG_SSL_CLIENT_CA_CERT_FILENAME = "TS_LUA_CONFIG_SSL_CLIENT_CA_CERT_FILENAME"
+      _G.TS_LUA_CONFIG_SSL_CLIENT_VERIFY_SERVER_POLICY = "TS_LUA_CONFIG_SSL_CLIENT_VERIFY_SERVER_POLICY"
+      _G.TS_LUA_CONFIG_SSL_CLIENT_VERIFY_SERVER_PROPERTIES = "TS_LUA_CONFIG_SSL_CLIENT_VERIFY_SERVER_PROPERTIES"
+      _G.TS_LUA_CONFIG_SSL_CLIENT_SNI_POLICY = "TS_LUA_CONFIG_SSL_CLIENT_SNI_POLICY"
+
+      require "connect_redis"
+      do_global_read_request()
+
+      assert.stub(ts.http.config_string_set).was.called_with(TS_LUA_CONFIG_SSL_CLIENT_CA_CERT_FILENAME, "/certs/trafficserver-test-2_ca_ca.crt")
+      assert.stub(ts.http.config_string_set).was.called_with(TS_LUA_CONFIG_SSL_CLIENT_VERIFY_SERVER_POLICY, "ENFORCED")
+      assert.stub(ts.http.config_string_set).was.called_with(TS_LUA_CONFIG_SSL_CLIENT_VERIFY_SERVER_PROPERTIES, "ALL")
+      assert.stub(ts.http.config_string_set).was.called_with(TS_LUA_CONFIG_SSL_CLIENT_SNI_POLICY, "host")
+      -- the name is only the Host ATS takes the SNI from
+      assert.are.equal("appsvc1.internal", ts.client_request.header['Host'])
+      send_request()
+      stub(ts, "hook")
+      assert.are.equal("verify.edge.com", ts.client_request.header['Host'])
+      assert.are.equal("verify.edge.com", ts.server_request.header['Host'])
+    end)
+
+    it("Test - Timeouts and retries", function()
+      client:select(2)
+      client:publish(1, "E+http://retry.edge.com/app1","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app/connect-timeout=5","@trafficserver-test-2/app/read-timeout=90","@trafficserver-test-2/app/retries=2","@trafficserver-test-2/app/retry-on=5xx")
+
+      local read_response, send_request
+      ts.hook = function(id, f)
+        if id == TS_LUA_HOOK_READ_RESPONSE_HDR then read_response = f end
+        if id == TS_LUA_HOOK_SEND_REQUEST_HDR then send_request = f end
+      end
+      stub(ts.client_request, "get_url_host").returns("retry.edge.com")
+      stub(ts.client_request, "get_uri").returns("/app1")
+      stub(ts.client_request, "get_method").returns("GET")
+      stub(ts.client_request, "get_uri_args").returns("q=1")
+      stub(ts.server_response, "get_status").returns(503)
+      stub(ts.http, "config_int_set")
+      stub(ts.http, "redirect_url_set")
+      ts.client_request.header = {['Host'] = 'retry.edge.com'}
+      ts.server_request.header = {['Host'] = '172.17.0.3:8080'}
+      _G.TS_LUA_HOOK_READ_RESPONSE_HDR = "TS_LUA_HOOK_READ_RESPONSE_HDR"
+      _G.TS_LUA_HOOK_SEND_REQUEST_HDR = "TS_LUA_HOOK_SEND_REQUEST_HDR"
+      _G.TS_LUA_CONFIG_HTTP_CONNECT_ATTEMPTS_TIMEOUT = "TS_LUA_CONFIG_HTTP_CONNECT_ATTEMPTS_TIMEOUT"
+      _G.TS_LUA_CONFIG_HTTP_TRANSACTION_NO_ACTIVITY_TIMEOUT_OUT = "TS_LUA_CONFIG_HTTP_TRANSACTION_NO_ACTIVITY_TIMEOUT_OUT"
+      _G.TS_LUA_CONFIG_HTTP_CONNECT_ATTEMPTS_MAX_RETRIES = "TS_LUA_CONFIG_HTTP_CONNECT_ATTEMPTS_MAX_RETRIES"
+      _G.TS_LUA_CONFIG_HTTP_NUMBER_OF_REDIRECTIONS = "TS_LUA_CONFIG_HTTP_NUMBER_OF_REDIRECTIONS"
+
+      require "connect_redis"
+      do_global_read_request()
+
+      -- the redirects of the backend are not followed
+      assert.stub(ts.http.config_int_set).was.called(3)
+      assert.stub(ts.http.config_int_set).was.called_with(TS_LUA_CONFIG_HTTP_CONNECT_ATTEMPTS_TIMEOUT, 5)
+      assert.stub(ts.http.config_int_set).was.called_with(TS_LUA_CONFIG_HTTP_TRANSACTION_NO_ACTIVITY_TIMEOUT_OUT, 90)
+      assert.stub(ts.http.config_int_set).was.called_with(TS_LUA_CONFIG_HTTP_CONNECT_ATTEMPTS_MAX_RETRIES, 0)
+
+      read_response()
+      send_request()
+      stub(ts, "hook")
+
+      assert.stub(ts.http.config_int_set).was.called_with(TS_LUA_CONFIG_HTTP_NUMBER_OF_REDIRECTIONS, 1)
+      assert.stub(ts.http.redirect_url_set).was.called_with(match.is_any_of(match.is_same("http://172.17.0.3:8080/app1?q=1"), match.is_same("http://172.17.0.5:8080/app1?q=1")))
+      assert.are.equal("retry.edge.com", ts.server_request.header['Host'])
+    end)
+
+    it("Test - Least requests with retries", function()
+      client:select(2)
+      client:publish(1, "E+http://least.edge.com/app1","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app/load-balance=least-requests","@trafficserver-test-2/app/retries=1","@trafficserver-test-2/app/retry-on=5xx")
+
+      local read_response, txn_close
+      ts.hook = function(id, f)
+        if id == TS_LUA_HOOK_READ_RESPONSE_HDR then read_response = f end
+        if id == TS_LUA_HOOK_TXN_CLOSE then txn_close = f end
+      end
+      stub(ts.client_request, "get_url_host").returns("least.edge.com")
+      stub(ts.client_request, "get_uri").returns("/app1")
+      stub(ts.client_request, "get_method").returns("GET")
+      stub(ts.client_request, "get_uri_args").returns("")
+      stub(ts.server_response, "get_status").returns(503)
+      stub(ts.http, "redirect_url_set")
+      _G.TS_LUA_HOOK_TXN_CLOSE = "TS_LUA_HOOK_TXN_CLOSE"
+
+      require "connect_redis"
+      do_global_read_request()
+      read_response()
+      txn_close()
+
+      -- the retried transaction left no request counted
+      stub(ts.client_request, "set_url_host")
+      do_global_read_request()
+      assert.stub(ts.client_request.set_url_host).was.called_with("172.17.0.3")
+      stub(ts.client_request, "set_url_host")
+      do_global_read_request()
+      assert.stub(ts.client_request.set_url_host).was.called_with("172.17.0.5")
+      stub(ts, "hook")
+    end)
+
+    it("Test - Headers", function()
+      client:select(2)
+      client:publish(1, "E+http://headers.edge.com/app1","trafficserver-test-2:appsvc1:8080","@trafficserver-test-2/app/request-header-set:X-Forwarded-Prefix=/app1","@trafficserver-test-2/app/request-header-set:X-Client=$client_ip on $host","@trafficserver-test-2/app/request-header-append:Via=ingress","@trafficserver-test-2/app/request-header-remove:Cookie=","@trafficserver-test-2/app/response-header-set:X-Request-ID=$request_id","@trafficserver-test-2/app/response-header-remove:Server=")
+
+      local send_response
+      ts.hook = function(id, f)
+        if id == TS_LUA_HOOK_SEND_RESPONSE_HDR then send_response = f end
+      end
+      stub(ts.client_request, "get_url_host").returns("headers.edge.com")
+      stub(ts.client_request, "get_uri").returns("/app1")
+      ts.client_request.client_addr = {}
+      stub(ts.client_request.client_addr, "get_addr").returns("10.0.0.1")
+      stub(ts.http, "id").returns(42)
+      ts.client_request.header = {['Via'] = 'client', ['Cookie'] = 'session=1'}
+      ts.client_response.header = {['Server'] = 'app'}
+
+      require "connect_redis"
+      do_global_read_request()
+      send_response()
+      stub(ts, "hook")
+
+      assert.are.equal("/app1", ts.client_request.header['X-Forwarded-Prefix'])
+      assert.are.equal("10.0.0.1 on headers.edge.com", ts.client_request.header['X-Client'])
+      assert.are.equal("client, ingress", ts.client_request.header['Via'])
+      assert.is_nil(ts.client_request.header['Cookie'])
+      assert.are.equal("42", ts.client_response.header['X-Request-ID'])
+      assert.is_nil(ts.client_response.header['Server'])
+    end)
+
 
   end)
 end)
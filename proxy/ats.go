@@ -29,6 +29,7 @@ type ATSManagerInterface interface {
 	ConfigGet(k string) (string, error)
 	CacheSet() (string, error)
 	SniSet() (string, error)
+	SslSet() (string, error)
 	IncludeIngressClass(c string) bool
 }
 
@@ -80,6 +81,16 @@ func (m *ATSManager) SniSet() (msg string, err error) {
 
 }
 
+// SslSet reloads the certificates of ssl_multicert.config
+func (m *ATSManager) SslSet() (msg string, err error) {
+	cmd := exec.Command("traffic_ctl", "config", "reload")
+	stdoutStderr, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to execute: traffic_ctl config reload Error: %s", err.Error())
+	}
+	return fmt.Sprintf("Reload succesful --> stdoutStderr: %q", stdoutStderr), nil
+}
+
 func (m *ATSManager) ConfigGet(k string) (msg string, err error) {
 	cmd := exec.Command("traffic_ctl", "config", "get", k)
 	stdoutStderr, err := cmd.CombinedOutput()
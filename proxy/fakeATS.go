@@ -45,6 +45,10 @@ func (m *FakeATSManager) CacheSet() (msg string, err error) {
 func (m *FakeATSManager) SniSet() (msg string, err error) {
 	return "Config reload succesful", nil
 }
+func (m *FakeATSManager) SslSet() (msg string, err error) {
+	return "Config reload succesful", nil
+}
+
 func (m *FakeATSManager) ConfigSet(k, v string) (msg string, err error) {
 	m.Config[k] = v
 	return fmt.Sprintf("Ran p.Key: %s p.Val: %s", k, v), nil
@@ -18,6 +18,8 @@ package redis
 import (
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/go-redis/redis"
@@ -27,6 +29,34 @@ import (
 type Client struct {
 	DefaultDB *redis.Client
 	DBOne     *redis.Client
+	// DBTwo holds the generations of DB 0 and DB 1 published to the router
+	DBTwo *redis.Client
+
+	mu sync.Mutex
+	// generation is the last generation published
+	generation int64
+	// dirty holds the version keys of the DB 0 and DB 1 keys written
+	// since the last generation
+	dirty map[string]dbKey
+	// versions maps the version keys published to DB Two to their versions
+	versions map[string]version
+	// removed maps the version keys of the deleted keys to the generation
+	// that deleted them
+	removed map[string]int64
+}
+
+// dbKey is a key of DB 0 or DB 1
+type dbKey struct {
+	db  int
+	key string
+}
+
+// version is the generation a key was last published in and the one it
+// was published in before, which the requests of the previous generation
+// still read
+type version struct {
+	current  int64
+	previous int64
 }
 
 const (
@@ -35,6 +65,14 @@ const (
 	RSUCCESS int64 = 1
 	// RFAIL is the failure code returned by a Redis op
 	RFAIL int64 = 0
+	// GenerationKey is the key of the active generation in DB Two
+	GenerationKey string = "generation"
+	// VersionField is the field of a version key holding the generation a
+	// key was last published in
+	VersionField string = "version"
+	// PreviousField is the field of a version key holding the generation a
+	// key was published in before
+	PreviousField string = "previous"
 )
 
 // TODO: Currently we have host/path --> ip --> port
@@ -81,7 +119,17 @@ func InitForTesting() (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{defaultDB, dbOne}, nil
+	dbTwo := redis.NewClient(&redis.Options{
+		Addr: mr.Addr(), // connect to domain socket
+		DB:   2,         // use DB number 2
+	})
+
+	_, err = dbTwo.Ping().Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{DefaultDB: defaultDB, DBOne: dbOne, DBTwo: dbTwo}, nil
 
 }
 
@@ -111,70 +159,289 @@ func CreateRedisClient() (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{defaultDB, dbOne}, nil
+	dbTwo := redis.NewClient(&redis.Options{
+		Network:  "unix",          // use default Addr
+		Addr:     redisSocketAddr, // connect to domain socket
+		Password: "",              // no password set
+		DB:       2,               // use DB number 2
+	})
+
+	_, err = dbTwo.Ping().Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{DefaultDB: defaultDB, DBOne: dbOne, DBTwo: dbTwo}, nil
 }
 
 //--------------------- Default DB: svc port --> []IPport ------------------------
 
-// DefaulDBSAdd does SAdd on Default DB and logs results
-func (c *Client) DefaultDBSAdd(svcport, ipport string) {
+// DefaultDBSAdd does SAdd on Default DB, logs and returns errors
+func (c *Client) DefaultDBSAdd(svcport, ipport string) error {
+	c.touch(0, svcport)
 	_, err := c.DefaultDB.SAdd(svcport, ipport).Result()
 	if err != nil {
 		log.Printf("DefaultDB.SAdd(%s, %s).Result() Error: %s\n", svcport, ipport, err.Error())
 	}
+	return err
 }
 
-// DefaultDBDel does Del on Default DB and logs results
-func (c *Client) DefaultDBDel(svcport string) {
+// DefaultDBDel does Del on Default DB, logs and returns errors
+func (c *Client) DefaultDBDel(svcport string) error {
+	c.touch(0, svcport)
 	// then delete host from Default DB
 	_, err := c.DefaultDB.Del(svcport).Result()
 	if err != nil {
 		log.Printf("DefaultDB.Del(%s).Result() Error: %s\n", svcport, err.Error())
 	}
+	return err
 }
 
-// DefaultDBSUnionStore does sunionstore on default db
-func (c *Client) DefaultDBSUnionStore(dest, src string) {
+// DefaultDBSUnionStore does sunionstore on default db, logs and returns errors
+func (c *Client) DefaultDBSUnionStore(dest, src string) error {
+	c.touch(0, dest)
 	_, err := c.DefaultDB.SUnionStore(dest, src).Result()
 	if err != nil {
 		log.Printf("DefaultDB.SUnionStore(%s, %s).Result() Error: %s\n", dest, src, err.Error())
 	}
+	return err
+}
+
+// DefaultDBSReplace atomically replaces the members of a set on Default DB,
+// deleting it when there are none, logs and returns errors
+func (c *Client) DefaultDBSReplace(svcport string, ipports []string) error {
+	c.touch(0, svcport)
+	_, err := c.DefaultDB.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(svcport)
+		if len(ipports) > 0 {
+			members := make([]interface{}, len(ipports))
+			for i, ipport := range ipports {
+				members[i] = ipport
+			}
+			pipe.SAdd(svcport, members...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("DefaultDB.TxPipelined(Del+SAdd %s).Result() Error: %s\n", svcport, err.Error())
+	}
+	return err
 }
 
 //----------------------- DB One: hostport --> []svc port -------------------------------
 
-// DBOneSAdd does SAdd on DB One and logs results
-func (c *Client) DBOneSAdd(hostport, svcport string) {
+// DBOneSAdd does SAdd on DB One, logs and returns errors
+func (c *Client) DBOneSAdd(hostport, svcport string) error {
+	c.touch(1, hostport)
 	_, err := c.DBOne.SAdd(hostport, svcport).Result()
 
 	if err != nil {
 		log.Printf("DBOne.SAdd(%s, %s).Result() Error: %s\n", hostport, svcport, err.Error())
 	}
+	return err
 }
 
-// DBOneSRem does SRem on DB One and logs results
-func (c *Client) DBOneSRem(hostport, svcport string) {
+// DBOneSRem does SRem on DB One, logs and returns errors
+func (c *Client) DBOneSRem(hostport, svcport string) error {
+	c.touch(1, hostport)
 	_, err := c.DBOne.SRem(hostport, svcport).Result()
 	if err != nil {
 		log.Printf("DBOne.SRem(%s, %s).Result() Error: %s\n", hostport, svcport, err.Error())
 	}
+	return err
 }
 
-// DBOneDel does Del on Default DB and logs results
-func (c *Client) DBOneDel(hostport string) {
+// DBOneSMembers does SMembers on DB One, logs and returns errors
+func (c *Client) DBOneSMembers(hostport string) ([]string, error) {
+	svcports, err := c.DBOne.SMembers(hostport).Result()
+	if err != nil {
+		log.Printf("DBOne.SMembers(%s).Result() Error: %s\n", hostport, err.Error())
+	}
+	return svcports, err
+}
+
+// DBOneDel does Del on DB One, logs and returns errors
+func (c *Client) DBOneDel(hostport string) error {
+	c.touch(1, hostport)
 	// then delete host from DB One
 	_, err := c.DBOne.Del(hostport).Result()
 	if err != nil {
 		log.Printf("DBOne.Del(%s).Result() Error: %s\n", hostport, err.Error())
 	}
+	return err
 }
 
-// DefaultDBSUnionStore does sunionstore on default db
-func (c *Client) DBOneSUnionStore(dest, src string) {
+// DBOneSUnionStore does sunionstore on DB One, logs and returns errors
+func (c *Client) DBOneSUnionStore(dest, src string) error {
+	c.touch(1, dest)
 	_, err := c.DBOne.SUnionStore(dest, src).Result()
 	if err != nil {
 		log.Printf("DBOne.SUnionStore(%s, %s).Result() Error: %s\n", dest, src, err.Error())
 	}
+	return err
+}
+
+// DBOneSReplace atomically replaces the members of a set on DB One,
+// deleting it when there are none, logs and returns errors
+func (c *Client) DBOneSReplace(hostport string, svcports []string) error {
+	c.touch(1, hostport)
+	_, err := c.DBOne.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(hostport)
+		if len(svcports) > 0 {
+			members := make([]interface{}, len(svcports))
+			for i, svcport := range svcports {
+				members[i] = svcport
+			}
+			pipe.SAdd(hostport, members...)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("DBOne.TxPipelined(Del+SAdd %s).Result() Error: %s\n", hostport, err.Error())
+	}
+	return err
+}
+
+//------------------ DB Two: generation --> DB 0 + DB 1 -----------------------
+
+// touch records that a key of DB 0 or DB 1 is written, for the next
+// generation to publish it
+func (c *Client) touch(db int, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dirty == nil {
+		c.dirty = make(map[string]dbKey)
+	}
+	c.dirty[VersionKeyOf(db, key)] = dbKey{db: db, key: key}
+}
+
+// Publish copies the keys of DB 0 and DB 1 written since the last
+// generation into a new generation on DB Two and makes it the active one
+// within a single transaction, so that the router never sees a change half
+// applied. The other keys keep the version they were last published in.
+// The version a key had before is kept for the requests still reading the
+// previous generation and deleted once the key is published again.
+func (c *Client) Publish() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.dirty) == 0 && c.generation > 0 {
+		return nil
+	}
+
+	values, err := c.dirtyValues()
+	if err != nil {
+		return err
+	}
+
+	generation := c.generation + 1
+	_, err = c.DBTwo.TxPipelined(func(pipe redis.Pipeliner) error {
+		for versionKey, dk := range c.dirty {
+			if members := values[versionKey]; len(members) > 0 {
+				pipe.SAdd(GenerationKeyOf(generation, dk.db, dk.key), members...)
+			}
+			pipe.HSet(versionKey, VersionField, generation)
+			if v, ok := c.versions[versionKey]; ok {
+				pipe.HSet(versionKey, PreviousField, v.current)
+			} else {
+				pipe.HDel(versionKey, PreviousField)
+			}
+		}
+		pipe.Set(GenerationKey, generation, 0)
+		return nil
+	})
+	if err != nil {
+		log.Printf("DBTwo.TxPipelined(generation %d).Result() Error: %s\n", generation, err.Error())
+		return err
+	}
+
+	if c.versions == nil {
+		c.versions = make(map[string]version)
+	}
+	if c.removed == nil {
+		c.removed = make(map[string]int64)
+	}
+	var stale []string
+	for versionKey, dk := range c.dirty {
+		v, ok := c.versions[versionKey]
+		if ok && v.previous > 0 {
+			// no request reads the generation it was active in anymore
+			stale = append(stale, GenerationKeyOf(v.previous, dk.db, dk.key))
+		}
+		c.versions[versionKey] = version{current: generation, previous: v.current}
+		if len(values[versionKey]) == 0 {
+			c.removed[versionKey] = generation
+		} else {
+			delete(c.removed, versionKey)
+		}
+	}
+	c.generation = generation
+	c.dirty = nil
+
+	// the keys deleted before the previous generation are not read anymore
+	for versionKey, gen := range c.removed {
+		if gen >= generation {
+			continue
+		}
+		v := c.versions[versionKey]
+		dk := dbKeyOf(versionKey)
+		stale = append(stale, versionKey, GenerationKeyOf(v.previous, dk.db, dk.key))
+		delete(c.versions, versionKey)
+		delete(c.removed, versionKey)
+	}
+
+	if len(stale) > 0 {
+		if _, err := c.DBTwo.Del(stale...).Result(); err != nil {
+			// the keys of DB Two are flushed on restart
+			log.Printf("DBTwo.Del(generation %d).Result() Error: %s\n", generation, err.Error())
+		}
+	}
+	return nil
+}
+
+// dirtyValues returns the members of the keys written since the last
+// generation, keyed by their version keys
+func (c *Client) dirtyValues() (map[string][]interface{}, error) {
+	pipes := []redis.Pipeliner{c.DefaultDB.Pipeline(), c.DBOne.Pipeline()}
+	cmds := make(map[string]*redis.StringSliceCmd, len(c.dirty))
+	for versionKey, dk := range c.dirty {
+		cmds[versionKey] = pipes[dk.db].SMembers(dk.key)
+	}
+	for db, pipe := range pipes {
+		_, err := pipe.Exec()
+		_ = pipe.Close()
+		if err != nil {
+			log.Printf("Pipeline(DB %d SMembers).Exec() Error: %s\n", db, err.Error())
+			return nil, err
+		}
+	}
+
+	values := make(map[string][]interface{}, len(cmds))
+	for versionKey, cmd := range cmds {
+		for _, member := range cmd.Val() {
+			values[versionKey] = append(values[versionKey], member)
+		}
+	}
+	return values, nil
+}
+
+// GenerationKeyOf returns the key of a DB 0 or DB 1 key in a generation
+func GenerationKeyOf(generation int64, db int, key string) string {
+	return fmt.Sprintf("%d/%d/%s", generation, db, key)
+}
+
+// VersionKeyOf returns the key of DB Two holding the generations a DB 0 or
+// DB 1 key was published in
+func VersionKeyOf(db int, key string) string {
+	return fmt.Sprintf("%d/%s", db, key)
+}
+
+// dbKeyOf returns the DB 0 or DB 1 key of a version key
+func dbKeyOf(versionKey string) dbKey {
+	if strings.HasPrefix(versionKey, "1/") {
+		return dbKey{db: 1, key: strings.TrimPrefix(versionKey, "1/")}
+	}
+	return dbKey{db: 0, key: strings.TrimPrefix(versionKey, "0/")}
 }
 
 //------------------------- Other ---------------------------------------------
@@ -187,13 +454,15 @@ func (c *Client) Flush() error {
 	return nil
 }
 
-// Close tries to close the 2 clients
+// Close tries to close the 3 clients
 func (c *Client) Close() {
 	_ = c.DefaultDB.Close()
 	_ = c.DBOne.Close()
+	_ = c.DBTwo.Close()
 	// for garbage collector
 	c.DefaultDB = nil
 	c.DBOne = nil
+	c.DBTwo = nil
 }
 
 // Terminate tries to flush the entire redis and close clients
@@ -221,76 +490,40 @@ func (c *Client) PrintAllKeys() {
 	}
 }
 
+// GetDefaultDBKeyValues returns the sets of Default DB, logging errors
 func (c *Client) GetDefaultDBKeyValues() map[string][]string {
-	var (
-		res         interface{}
-		err         error
-		keyValueMap map[string][]string
-	)
-
-	if res, err = c.DefaultDB.Do("KEYS", "*").Result(); err != nil {
-		log.Println("Error Printing DB One (1): ", err)
-	}
-
-	keyValueMap = make(map[string][]string)
-
-	switch keys := res.(type) {
-	case []interface{}:
-		for _, key := range keys {
-			if smembers, err := c.DefaultDB.Do("SMEMBERS", key).Result(); err != nil {
-				log.Println("Error Printing DB One (1): ", err)
-			} else {
-				keyValueMap[key.(string)] = []string{}
-				switch values := smembers.(type) {
-				case []interface{}:
-					for _, value := range values {
-						keyValueMap[key.(string)] = append(keyValueMap[key.(string)], value.(string))
-					}
-				default:
-					fmt.Printf("Cannot iterate over %T\n", smembers)
-				}
-			}
-		}
-	default:
-		fmt.Printf("Cannot iterate over %T\n", res)
+	keyValueMap, err := keyValues(c.DefaultDB)
+	if err != nil {
+		log.Println("Error Printing Default DB (0): ", err)
 	}
-
 	return keyValueMap
 }
 
+// GetDBOneKeyValues returns the sets of DB One, logging errors
 func (c *Client) GetDBOneKeyValues() map[string][]string {
-	var (
-		res         interface{}
-		err         error
-		keyValueMap map[string][]string
-	)
-
-	if res, err = c.DBOne.Do("KEYS", "*").Result(); err != nil {
+	keyValueMap, err := keyValues(c.DBOne)
+	if err != nil {
 		log.Println("Error Printing DB One (1): ", err)
 	}
+	return keyValueMap
+}
 
-	keyValueMap = make(map[string][]string)
+// keyValues returns the members of every set of a DB. The sets read before
+// an error are returned along with it.
+func keyValues(db *redis.Client) (map[string][]string, error) {
+	keyValueMap := make(map[string][]string)
 
-	switch keys := res.(type) {
-	case []interface{}:
-		for _, key := range keys {
-			if smembers, err := c.DBOne.Do("SMEMBERS", key).Result(); err != nil {
-				log.Println("Error Printing DB One (1): ", err)
-			} else {
-				keyValueMap[key.(string)] = []string{}
-				switch values := smembers.(type) {
-				case []interface{}:
-					for _, value := range values {
-						keyValueMap[key.(string)] = append(keyValueMap[key.(string)], value.(string))
-					}
-				default:
-					fmt.Printf("Cannot iterate over %T\n", smembers)
-				}
-			}
-		}
-	default:
-		fmt.Printf("Cannot iterate over %T\n", res)
+	keys, err := db.Keys("*").Result()
+	if err != nil {
+		return keyValueMap, err
 	}
 
-	return keyValueMap
+	for _, key := range keys {
+		smembers, err := db.SMembers(key).Result()
+		if err != nil {
+			return keyValueMap, fmt.Errorf("SMEMBERS %s: %v", key, err)
+		}
+		keyValueMap[key] = append([]string{}, smembers...)
+	}
+	return keyValueMap, nil
 }
@@ -14,8 +14,10 @@ limitations under the License.
 package redis
 
 import (
-	"github.com/apache/trafficserver-ingress-controller/util"
+	"reflect"
 	"testing"
+
+	"github.com/apache/trafficserver-ingress-controller/util"
 )
 
 func TestInit(t *testing.T) {
@@ -126,6 +128,42 @@ func TestDefaultDBSUnionStore(t *testing.T) {
 	}
 }
 
+func TestDefaultDBSReplace(t *testing.T) {
+	rClient, _ := InitForTesting()
+
+	rClient.DefaultDBSAdd("test-key", "test-val")
+	rClient.DefaultDBSAdd("test-key", "test-val-old")
+	rClient.DefaultDBSAdd("test-key-2", "test-val-2")
+	rClient.DefaultDBSReplace("test-key", []string{"test-val", "test-val-new"})
+	rClient.DefaultDBSReplace("test-key-2", nil)
+
+	returnedKeys := rClient.GetDefaultDBKeyValues()
+	expectedKeys := make(map[string][]string)
+	expectedKeys["test-key"] = []string{"test-val", "test-val-new"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestDBOneSReplace(t *testing.T) {
+	rClient, _ := InitForTesting()
+
+	rClient.DBOneSAdd("test-key", "test-val")
+	rClient.DBOneSAdd("test-key", "test-val-old")
+	rClient.DBOneSAdd("test-key-2", "test-val-2")
+	rClient.DBOneSReplace("test-key", []string{"test-val", "test-val-new"})
+	rClient.DBOneSReplace("test-key-2", nil)
+
+	returnedKeys := rClient.GetDBOneKeyValues()
+	expectedKeys := make(map[string][]string)
+	expectedKeys["test-key"] = []string{"test-val", "test-val-new"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
 func TestDBOneSAdd(t *testing.T) {
 	rClient, _ := InitForTesting()
 
@@ -190,6 +228,143 @@ func TestDBOneSUnionStore(t *testing.T) {
 	}
 }
 
+func TestPublish(t *testing.T) {
+	rClient, _ := InitForTesting()
+
+	rClient.DefaultDBSAdd("test-svc", "test-ipport")
+	rClient.DBOneSAdd("test-hostpath", "test-svc")
+	if err := rClient.Publish(); err != nil {
+		t.Fatal(err)
+	}
+
+	rClient.DefaultDBSAdd("test-svc", "test-ipport-2")
+	rClient.DBOneDel("test-hostpath")
+	if err := rClient.Publish(); err != nil {
+		t.Fatal(err)
+	}
+
+	generation, _ := rClient.DBTwo.Get(GenerationKey).Result()
+	if generation != "2" {
+		t.Errorf("returned generation %s, but expected 2", generation)
+	}
+
+	returnedKeys := getDBTwoKeyValues(rClient)
+	expectedKeys := make(map[string][]string)
+	expectedKeys["1/0/test-svc"] = []string{"test-ipport"}
+	expectedKeys["1/1/test-hostpath"] = []string{"test-svc"}
+	expectedKeys["2/0/test-svc"] = []string{"test-ipport", "test-ipport-2"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+
+	returnedVersions := getDBTwoVersions(rClient)
+	expectedVersions := make(map[string]map[string]string)
+	expectedVersions["0/test-svc"] = map[string]string{VersionField: "2", PreviousField: "1"}
+	expectedVersions["1/test-hostpath"] = map[string]string{VersionField: "2", PreviousField: "1"}
+
+	if !reflect.DeepEqual(returnedVersions, expectedVersions) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedVersions, expectedVersions)
+	}
+
+	// the deleted key is not read by the previous generation anymore
+	rClient.DefaultDBSAdd("test-svc-2", "test-ipport")
+	if err := rClient.Publish(); err != nil {
+		t.Fatal(err)
+	}
+
+	returnedKeys = getDBTwoKeyValues(rClient)
+	delete(expectedKeys, "1/1/test-hostpath")
+	expectedKeys["3/0/test-svc-2"] = []string{"test-ipport"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+
+	returnedVersions = getDBTwoVersions(rClient)
+	delete(expectedVersions, "1/test-hostpath")
+	expectedVersions["0/test-svc-2"] = map[string]string{VersionField: "3"}
+
+	if !reflect.DeepEqual(returnedVersions, expectedVersions) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedVersions, expectedVersions)
+	}
+
+	// the version before the previous one is deleted once a key is published again
+	rClient.DefaultDBSReplace("test-svc", []string{"test-ipport-2"})
+	if err := rClient.Publish(); err != nil {
+		t.Fatal(err)
+	}
+
+	returnedKeys = getDBTwoKeyValues(rClient)
+	delete(expectedKeys, "1/0/test-svc")
+	expectedKeys["4/0/test-svc"] = []string{"test-ipport-2"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestPublish_UnrelatedKeyNotRewritten(t *testing.T) {
+	rClient, _ := InitForTesting()
+
+	rClient.DefaultDBSAdd("test-svc", "test-ipport")
+	rClient.DefaultDBSAdd("test-svc-2", "test-ipport")
+	if err := rClient.Publish(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is published without a change
+	if err := rClient.Publish(); err != nil {
+		t.Fatal(err)
+	}
+	generation, _ := rClient.DBTwo.Get(GenerationKey).Result()
+	if generation != "1" {
+		t.Errorf("returned generation %s, but expected 1", generation)
+	}
+
+	rClient.DefaultDBSReplace("test-svc", []string{"test-ipport-2"})
+	if err := rClient.Publish(); err != nil {
+		t.Fatal(err)
+	}
+
+	exists, _ := rClient.DBTwo.Exists(GenerationKeyOf(2, 0, "test-svc-2")).Result()
+	if exists != 0 {
+		t.Errorf("unrelated key test-svc-2 was rewritten in generation 2")
+	}
+	version, _ := rClient.DBTwo.HGet(VersionKeyOf(0, "test-svc-2"), VersionField).Result()
+	if version != "1" {
+		t.Errorf("returned version %s of test-svc-2, but expected 1", version)
+	}
+	version, _ = rClient.DBTwo.HGet(VersionKeyOf(0, "test-svc"), VersionField).Result()
+	if version != "2" {
+		t.Errorf("returned version %s of test-svc, but expected 2", version)
+	}
+}
+
+// getDBTwoKeyValues returns the sets of the generations in DB Two
+func getDBTwoKeyValues(rClient *Client) map[string][]string {
+	keyValueMap := make(map[string][]string)
+	keys, _ := rClient.DBTwo.Keys("*/*").Result()
+	for _, key := range keys {
+		if keyType, _ := rClient.DBTwo.Type(key).Result(); keyType == "set" {
+			keyValueMap[key], _ = rClient.DBTwo.SMembers(key).Result()
+		}
+	}
+	return keyValueMap
+}
+
+// getDBTwoVersions returns the version keys in DB Two
+func getDBTwoVersions(rClient *Client) map[string]map[string]string {
+	versions := make(map[string]map[string]string)
+	keys, _ := rClient.DBTwo.Keys("*/*").Result()
+	for _, key := range keys {
+		if keyType, _ := rClient.DBTwo.Type(key).Result(); keyType == "hash" {
+			versions[key], _ = rClient.DBTwo.HGetAll(key).Result()
+		}
+	}
+	return versions
+}
+
 func getExpectedKeysForAdd() map[string][]string {
 	expectedKeys := make(map[string][]string)
 	expectedKeys["test-key"] = make([]string, 1)
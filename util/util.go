@@ -20,9 +20,17 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unicode"
 
+	"github.com/yuin/gopher-lua/parse"
+	"github.com/yuin/gopher-lua/pm"
 	nv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // Writer writes the JSON file synchronously
@@ -39,8 +47,137 @@ const (
 	// Define annotations we check for in the watched resources
 	AnnotationServerSnippet = "ats.ingress.kubernetes.io/server-snippet"
 	AnnotationIngressClass  = "kubernetes.io/ingress.class"
+	AnnotationSSLRedirect   = "ats.ingress.kubernetes.io/ssl-redirect"
+	// AnnotationRewriteTarget is the path requests are forwarded with. $1
+	// to $9 are replaced by the captures of AnnotationRewritePattern.
+	AnnotationRewriteTarget  = "ats.ingress.kubernetes.io/rewrite-target"
+	AnnotationRewritePattern = "ats.ingress.kubernetes.io/rewrite-pattern"
+	AnnotationStripPrefix    = "ats.ingress.kubernetes.io/strip-prefix"
+	// AnnotationCanary makes the backends of an Ingress the canary of the
+	// Ingress with the same host/paths
+	AnnotationCanary              = "ats.ingress.kubernetes.io/canary"
+	AnnotationCanaryWeight        = "ats.ingress.kubernetes.io/canary-weight"
+	AnnotationCanaryByHeader      = "ats.ingress.kubernetes.io/canary-by-header"
+	AnnotationCanaryByHeaderValue = "ats.ingress.kubernetes.io/canary-by-header-value"
+	AnnotationCanaryByCookie      = "ats.ingress.kubernetes.io/canary-by-cookie"
+	// AnnotationLoadBalance is the algorithm picking the endpoint of the
+	// backends. AnnotationUpstreamHashBy is the key of consistent-hash.
+	AnnotationLoadBalance    = "ats.ingress.kubernetes.io/load-balance"
+	AnnotationUpstreamHashBy = "ats.ingress.kubernetes.io/upstream-hash-by"
+	// AnnotationBackendProtocol is the protocol ATS speaks to the backends,
+	// set on Ingresses or Services
+	AnnotationBackendProtocol = "ats.ingress.kubernetes.io/backend-protocol"
+	// AnnotationProxySSLCASecret names the Secret of the CA certificates
+	// verifying https backends, in the namespace of the Ingress
+	AnnotationProxySSLCASecret     = "ats.ingress.kubernetes.io/proxy-ssl-ca-secret"
+	AnnotationProxySSLName         = "ats.ingress.kubernetes.io/proxy-ssl-name"
+	AnnotationProxySSLClientSecret = "ats.ingress.kubernetes.io/proxy-ssl-client-secret"
+	// AnnotationConnectTimeout and AnnotationReadTimeout are in seconds,
+	// or durations such as 1m30s
+	AnnotationConnectTimeout = "ats.ingress.kubernetes.io/connect-timeout"
+	AnnotationReadTimeout    = "ats.ingress.kubernetes.io/read-timeout"
+	// AnnotationRetryOn is a comma separated list of RetryOn values
+	AnnotationRetries = "ats.ingress.kubernetes.io/retries"
+	AnnotationRetryOn = "ats.ingress.kubernetes.io/retry-on"
+	// The set and append annotations of headers hold a "Name: value" per
+	// line, and the remove annotations a comma separated list of names
+	AnnotationRequestHeadersSet     = "ats.ingress.kubernetes.io/request-headers-set"
+	AnnotationRequestHeadersAppend  = "ats.ingress.kubernetes.io/request-headers-append"
+	AnnotationRequestHeadersRemove  = "ats.ingress.kubernetes.io/request-headers-remove"
+	AnnotationResponseHeadersSet    = "ats.ingress.kubernetes.io/response-headers-set"
+	AnnotationResponseHeadersAppend = "ats.ingress.kubernetes.io/response-headers-append"
+	AnnotationResponseHeadersRemove = "ats.ingress.kubernetes.io/response-headers-remove"
 )
 
+const (
+	// Define the options of a route, stored next to its services
+	RouteOptionSSLRedirect         = "ssl-redirect"
+	RouteOptionRewritePattern      = "rewrite-pattern"
+	RouteOptionRewriteTarget       = "rewrite-target"
+	RouteOptionStripPrefix         = "strip-prefix"
+	RouteOptionCanaryBackend       = "canary-backend"
+	RouteOptionCanaryWeight        = "canary-weight"
+	RouteOptionCanaryByHeader      = "canary-by-header"
+	RouteOptionCanaryByHeaderValue = "canary-by-header-value"
+	RouteOptionCanaryByCookie      = "canary-by-cookie"
+	RouteOptionLoadBalance         = "load-balance"
+	RouteOptionUpstreamHashBy      = "upstream-hash-by"
+	RouteOptionBackendProtocol     = "backend-protocol"
+	RouteOptionProxySSLCA          = "proxy-ssl-ca"
+	RouteOptionProxySSLName        = "proxy-ssl-name"
+	RouteOptionProxySSLCert        = "proxy-ssl-cert"
+	RouteOptionProxySSLKey         = "proxy-ssl-key"
+	RouteOptionConnectTimeout      = "connect-timeout"
+	RouteOptionReadTimeout         = "read-timeout"
+	RouteOptionRetries             = "retries"
+	RouteOptionRetryOn             = "retry-on"
+	// The route options of headers are followed by ":" and the name of the
+	// header
+	RouteOptionRequestHeaderSet     = "request-header-set"
+	RouteOptionRequestHeaderAppend  = "request-header-append"
+	RouteOptionRequestHeaderRemove  = "request-header-remove"
+	RouteOptionResponseHeaderSet    = "response-header-set"
+	RouteOptionResponseHeaderAppend = "response-header-append"
+	RouteOptionResponseHeaderRemove = "response-header-remove"
+)
+
+const (
+	// Define the failures requests are retried on
+	RetryOnConnectFailure = "connect-failure"
+	RetryOn5xx            = "5xx"
+)
+
+// MaxRetries bounds the retries annotation
+const MaxRetries = 10
+
+const (
+	// Define the load balancing algorithms of the backends
+	LoadBalanceRandom         = "random"
+	LoadBalanceRoundRobin     = "round-robin"
+	LoadBalanceLeastRequests  = "least-requests"
+	LoadBalanceConsistentHash = "consistent-hash"
+)
+
+// rewriteReference matches the $ of the rewrite target that are not
+// followed by a capture number
+var rewriteReference = regexp.MustCompile(`\$([^0-9]|$)`)
+
+// regexOnlySyntax lists what regular expressions, as used by other ingress
+// controllers, mean differently from Lua patterns: alternation, backslash
+// escapes, counted repetitions, groups with flags and lazy quantifiers.
+var regexOnlySyntax = []string{"|", "\\", "{", "}", "(?", "*?", "+?"}
+
+// regexSyntax returns the regular expression syntax found in a Lua pattern
+// outside of % escapes, empty when there is none.
+func regexSyntax(pattern string) string {
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '%' {
+			i++
+			continue
+		}
+		for _, syntax := range regexOnlySyntax {
+			if strings.HasPrefix(pattern[i:], syntax) {
+				return syntax
+			}
+		}
+	}
+	return ""
+}
+
+// token matches the names of headers and cookies
+var token = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// headerVariable matches the variables substituted in the values of headers
+var headerVariable = regexp.MustCompile(`\$([A-Za-z_]+)`)
+
+// HeaderVariables are the variables the router substitutes in the values of
+// headers
+var HeaderVariables = map[string]bool{
+	"client_ip":  true,
+	"host":       true,
+	"request_id": true,
+}
+
 // SyncWriteJSONFile writes obj, intended to be HostGroup, into a JSON file
 // under filename.
 func (w *Writer) SyncWriteJSONFile(obj interface{}) error {
@@ -119,23 +256,75 @@ func ConstructSvcPortString(namespace, svc, port string) string {
 	return namespace + ":" + svc + ":" + port
 }
 
+// backendProtocols are the protocols of the backend-protocol annotation, in
+// the form they take in Redis
+var backendProtocols = map[string]bool{"http": true, "https": true, "h2c": true, "grpc": true, "grpcs": true}
+
 // ConstructIPPortString constructs the string representation of ip, port
+// and the protocol of the backend
 func ConstructIPPortString(ip, port, protocol string) string {
-	if protocol != "https" {
+	if !backendProtocols[protocol] {
 		protocol = "http"
 	}
 	return ip + "#" + port + "#" + protocol
 }
 
+// BackendProtocol returns the protocol of a backend port: the one of the
+// backend-protocol annotation if any, else https for ports named https and
+// http for the others
+func BackendProtocol(annotated, portName string) string {
+	if annotated != "" {
+		return annotated
+	}
+	if portName == "https" {
+		return "https"
+	}
+	return "http"
+}
+
 func ConstructNameVersionString(namespace, name, version string) string {
 	return "$" + namespace + "/" + name + "/" + version
 }
 
+// ConstructRouteOptionString constructs the string representation of an
+// option of a host/path route
+func ConstructRouteOptionString(option, value string) string {
+	return "@" + option + "=" + value
+}
+
+// ConstructOwnedRouteOptionString qualifies the string of a route option
+// with the namespace and name of the Ingress setting it, which keeps apart
+// the options of the Ingresses sharing a host/path
+func ConstructOwnedRouteOptionString(namespace, name, option string) string {
+	return "@" + namespace + "/" + name + "/" + strings.TrimPrefix(option, "@")
+}
+
+// ParseOwnedRouteOptionString returns the Ingress, as namespace/name, the
+// option and the value of an owned route option string. ok is false when
+// the string is not one.
+func ParseOwnedRouteOptionString(s string) (owner, option, value string, ok bool) {
+	if !strings.HasPrefix(s, "@") {
+		return "", "", "", false
+	}
+	parts := strings.SplitN(s[1:], "/", 3)
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	option, value, ok = strings.Cut(parts[2], "=")
+	return parts[0] + "/" + parts[1], option, value, ok
+}
+
 // Itos : Interface to String
 func Itos(obj interface{}) string {
 	return fmt.Sprintf("%v", obj)
 }
 
+// ValidateSnippet checks the Lua syntax of a snippet
+func ValidateSnippet(snippet string) error {
+	_, err := parse.Parse(strings.NewReader(snippet), "server-snippet")
+	return err
+}
+
 func ExtractServerSnippet(ann map[string]string) (snippet string, err error) {
 
 	server_snippet, ok := ann[AnnotationServerSnippet]
@@ -156,6 +345,295 @@ func ExtractIngressClass(ann map[string]string) (class string, err error) {
 	return ingress_class, nil
 }
 
+// ExtractSSLRedirect tells if the annotation asks for plain http requests to
+// be redirected to https. ok is false when the annotation is not set.
+func ExtractSSLRedirect(ann map[string]string) (redirect bool, ok bool, err error) {
+	return extractBool(ann, AnnotationSSLRedirect)
+}
+
+// ExtractStripPrefix tells if the annotation asks for the path of a route
+// to be removed from the requests forwarded. ok is false when the
+// annotation is not set.
+func ExtractStripPrefix(ann map[string]string) (strip bool, ok bool, err error) {
+	return extractBool(ann, AnnotationStripPrefix)
+}
+
+// ExtractCanary returns the route options selecting the requests sent to
+// the backends of a canary Ingress. ok is false when the Ingress is not a
+// canary.
+func ExtractCanary(ann map[string]string) (options []string, ok bool, err error) {
+	canary, _, err := extractBool(ann, AnnotationCanary)
+	if err != nil || !canary {
+		return nil, canary, err
+	}
+
+	if weight, ok := ann[AnnotationCanaryWeight]; ok {
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 || w > 100 {
+			return nil, true, fmt.Errorf("invalid annotation '%s': %q is not a percentage", AnnotationCanaryWeight, weight)
+		}
+		options = append(options, ConstructRouteOptionString(RouteOptionCanaryWeight, strconv.Itoa(w)))
+	}
+
+	if header, ok := ann[AnnotationCanaryByHeader]; ok {
+		if !token.MatchString(header) {
+			return nil, true, fmt.Errorf("invalid annotation '%s': %q is not a header name", AnnotationCanaryByHeader, header)
+		}
+		options = append(options, ConstructRouteOptionString(RouteOptionCanaryByHeader, header))
+
+		if value, ok := ann[AnnotationCanaryByHeaderValue]; ok {
+			options = append(options, ConstructRouteOptionString(RouteOptionCanaryByHeaderValue, value))
+		}
+	}
+
+	if cookie, ok := ann[AnnotationCanaryByCookie]; ok {
+		if !token.MatchString(cookie) {
+			return nil, true, fmt.Errorf("invalid annotation '%s': %q is not a cookie name", AnnotationCanaryByCookie, cookie)
+		}
+		options = append(options, ConstructRouteOptionString(RouteOptionCanaryByCookie, cookie))
+	}
+
+	return options, true, nil
+}
+
+// ExtractLoadBalance returns the route options of the load balancing
+// algorithm of the backends, none for the default random one
+func ExtractLoadBalance(ann map[string]string) (options []string, err error) {
+	algorithm, ok := ann[AnnotationLoadBalance]
+	if !ok {
+		return nil, nil
+	}
+
+	switch algorithm {
+	case LoadBalanceRandom:
+		return nil, nil
+	case LoadBalanceRoundRobin, LoadBalanceLeastRequests:
+		return []string{ConstructRouteOptionString(RouteOptionLoadBalance, algorithm)}, nil
+	case LoadBalanceConsistentHash:
+		hashBy := ann[AnnotationUpstreamHashBy]
+		kind, name, _ := strings.Cut(hashBy, ":")
+		switch {
+		case hashBy == "ip":
+		case (kind == "header" || kind == "cookie") && token.MatchString(name):
+		default:
+			return nil, fmt.Errorf("invalid annotation '%s': %q is not ip, header:<name> nor cookie:<name>", AnnotationUpstreamHashBy, hashBy)
+		}
+		return []string{
+			ConstructRouteOptionString(RouteOptionLoadBalance, algorithm),
+			ConstructRouteOptionString(RouteOptionUpstreamHashBy, hashBy),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid annotation '%s': unknown algorithm %q", AnnotationLoadBalance, algorithm)
+}
+
+// ExtractBackendProtocol returns the backend protocol of the annotation in
+// lower case, empty when the annotation is not set
+func ExtractBackendProtocol(ann map[string]string) (protocol string, err error) {
+	backend_protocol, ok := ann[AnnotationBackendProtocol]
+	if !ok {
+		return "", nil
+	}
+
+	protocol = strings.ToLower(backend_protocol)
+	if !backendProtocols[protocol] {
+		return "", fmt.Errorf("invalid annotation '%s': %q is not HTTP, HTTPS, H2C, GRPC nor GRPCS", AnnotationBackendProtocol, backend_protocol)
+	}
+
+	return protocol, nil
+}
+
+// ExtractProxySSL returns the names of the CA and client certificate Secrets
+// of the https backends, and the name their certificates are verified
+// against. Those not annotated are empty.
+func ExtractProxySSL(ann map[string]string) (caSecret, name, clientSecret string, err error) {
+	for annotation, value := range map[string]*string{
+		AnnotationProxySSLCASecret:     &caSecret,
+		AnnotationProxySSLName:         &name,
+		AnnotationProxySSLClientSecret: &clientSecret,
+	} {
+		*value = ann[annotation]
+		if *value == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Subdomain(*value); len(errs) > 0 {
+			return "", "", "", fmt.Errorf("invalid annotation '%s': %q %s", annotation, *value, strings.Join(errs, ", "))
+		}
+	}
+
+	return caSecret, name, clientSecret, nil
+}
+
+// ExtractTimeoutsAndRetries returns the route options of the timeouts and
+// retries of the backends. Timeouts are stored in seconds. Without
+// retry-on, requests are retried on connect failures.
+func ExtractTimeoutsAndRetries(ann map[string]string) (options []string, err error) {
+	for _, timeout := range []struct{ annotation, option string }{
+		{AnnotationConnectTimeout, RouteOptionConnectTimeout},
+		{AnnotationReadTimeout, RouteOptionReadTimeout},
+	} {
+		annotation, option := timeout.annotation, timeout.option
+		value, ok := ann[annotation]
+		if !ok {
+			continue
+		}
+		seconds, err := parseSeconds(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation '%s': %v", annotation, err)
+		}
+		options = append(options, ConstructRouteOptionString(option, strconv.Itoa(seconds)))
+	}
+
+	retries, ok := ann[AnnotationRetries]
+	if !ok {
+		if _, ok := ann[AnnotationRetryOn]; ok {
+			return nil, fmt.Errorf("annotation '%s' needs annotation '%s'", AnnotationRetryOn, AnnotationRetries)
+		}
+		return options, nil
+	}
+	n, err := strconv.Atoi(retries)
+	if err != nil || n < 0 || n > MaxRetries {
+		return nil, fmt.Errorf("invalid annotation '%s': %q is not a number from 0 to %d", AnnotationRetries, retries, MaxRetries)
+	}
+	options = append(options, ConstructRouteOptionString(RouteOptionRetries, strconv.Itoa(n)))
+
+	retryOn := RetryOnConnectFailure
+	if value, ok := ann[AnnotationRetryOn]; ok {
+		var conditions []string
+		for _, condition := range strings.Split(value, ",") {
+			condition = strings.TrimSpace(condition)
+			if condition != RetryOnConnectFailure && condition != RetryOn5xx {
+				return nil, fmt.Errorf("invalid annotation '%s': %q is not %s nor %s", AnnotationRetryOn, condition, RetryOnConnectFailure, RetryOn5xx)
+			}
+			conditions = append(conditions, condition)
+		}
+		retryOn = strings.Join(conditions, ",")
+	}
+	options = append(options, ConstructRouteOptionString(RouteOptionRetryOn, retryOn))
+
+	return options, nil
+}
+
+// ExtractHeaders returns the route options of the headers set, appended to
+// and removed from the requests to the backends and their responses
+func ExtractHeaders(ann map[string]string) (options []string, err error) {
+	for _, headers := range []struct{ annotation, option string }{
+		{AnnotationRequestHeadersRemove, RouteOptionRequestHeaderRemove},
+		{AnnotationResponseHeadersRemove, RouteOptionResponseHeaderRemove},
+	} {
+		value, ok := ann[headers.annotation]
+		if !ok {
+			continue
+		}
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if !token.MatchString(name) {
+				return nil, fmt.Errorf("invalid annotation '%s': %q is not the name of a header", headers.annotation, name)
+			}
+			options = append(options, ConstructRouteOptionString(headers.option+":"+name, ""))
+		}
+	}
+
+	for _, headers := range []struct{ annotation, option string }{
+		{AnnotationRequestHeadersSet, RouteOptionRequestHeaderSet},
+		{AnnotationRequestHeadersAppend, RouteOptionRequestHeaderAppend},
+		{AnnotationResponseHeadersSet, RouteOptionResponseHeaderSet},
+		{AnnotationResponseHeadersAppend, RouteOptionResponseHeaderAppend},
+	} {
+		value, ok := ann[headers.annotation]
+		if !ok {
+			continue
+		}
+		names := make(map[string]bool)
+		for _, line := range strings.Split(value, "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			name, headerValue, found := strings.Cut(line, ":")
+			name = strings.TrimSpace(name)
+			headerValue = strings.TrimSpace(headerValue)
+			if !found || !token.MatchString(name) {
+				return nil, fmt.Errorf("invalid annotation '%s': %q is not a header", headers.annotation, line)
+			}
+			if names[strings.ToLower(name)] {
+				return nil, fmt.Errorf("invalid annotation '%s': header %s is repeated", headers.annotation, name)
+			}
+			names[strings.ToLower(name)] = true
+			if strings.ContainsFunc(headerValue, unicode.IsControl) {
+				return nil, fmt.Errorf("invalid annotation '%s': the value of header %s has control characters", headers.annotation, name)
+			}
+			for _, variable := range headerVariable.FindAllStringSubmatch(headerValue, -1) {
+				if !HeaderVariables[variable[1]] {
+					return nil, fmt.Errorf("invalid annotation '%s': unknown variable $%s", headers.annotation, variable[1])
+				}
+			}
+			options = append(options, ConstructRouteOptionString(headers.option+":"+name, headerValue))
+		}
+	}
+
+	return options, nil
+}
+
+// parseSeconds parses a number of seconds, or a duration rounded up to the
+// second
+func parseSeconds(value string) (int, error) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		d, durationErr := time.ParseDuration(value)
+		if durationErr != nil {
+			return 0, fmt.Errorf("%q is not a number of seconds nor a duration", value)
+		}
+		seconds = int((d + time.Second - 1) / time.Second)
+	}
+	if seconds <= 0 {
+		return 0, fmt.Errorf("%q is not positive", value)
+	}
+	return seconds, nil
+}
+
+func extractBool(ann map[string]string, annotation string) (value bool, ok bool, err error) {
+	str, ok := ann[annotation]
+	if !ok {
+		return false, false, nil
+	}
+
+	value, err = strconv.ParseBool(str)
+	if err != nil {
+		return false, true, fmt.Errorf("invalid annotation '%s': %q", annotation, str)
+	}
+
+	return value, true, nil
+}
+
+// ExtractRewriteTarget returns the rewrite target and the Lua pattern it is
+// applied with, empty when not given. ok is false when there is no target.
+// Patterns using regular expression syntax are rejected rather than matched
+// differently than their authors expect.
+func ExtractRewriteTarget(ann map[string]string) (pattern string, target string, ok bool, err error) {
+	target, ok = ann[AnnotationRewriteTarget]
+	if !ok {
+		return "", "", false, nil
+	}
+	if !strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "$") {
+		return "", "", true, fmt.Errorf("invalid annotation '%s': %q does not start with / or a capture", AnnotationRewriteTarget, target)
+	}
+	if rewriteReference.MatchString(target) {
+		return "", "", true, fmt.Errorf("invalid annotation '%s': %q has a $ not followed by a capture number", AnnotationRewriteTarget, target)
+	}
+
+	pattern = ann[AnnotationRewritePattern]
+	if pattern != "" {
+		if _, err := pm.Find(pattern, nil, 0, 1); err != nil {
+			return "", "", true, fmt.Errorf("invalid annotation '%s': %v", AnnotationRewritePattern, err)
+		}
+		if syntax := regexSyntax(pattern); syntax != "" {
+			return "", "", true, fmt.Errorf("invalid annotation '%s': %q uses %q of regular expressions, which Lua patterns do not have", AnnotationRewritePattern, pattern, syntax)
+		}
+	}
+
+	return pattern, target, true, nil
+}
+
 func ExtractIngressClassName(obj interface{}) (class string, err error) {
 	ingressObj, ok := obj.(*nv1.Ingress)
 	if !ok {
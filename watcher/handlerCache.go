@@ -24,7 +24,7 @@ func NewAtsCacheHandler(resource string, ep *endpoint.Endpoint, path string) *At
 }
 
 // Update ATS config
-func (h *AtsCacheHandler) UpdateAts() {
+func (h *AtsCacheHandler) UpdateAts() error {
 	log.Println("Update ATS called")
 	msg, err := h.Ep.ATSManager.CacheSet()
 	if err != nil {
@@ -32,17 +32,44 @@ func (h *AtsCacheHandler) UpdateAts() {
 	} else {
 		log.Println("ATS updated:", msg)
 	}
+	return err
 }
 
 // Add handles creation of ATSCachingPolicy resources
 func (h *AtsCacheHandler) Add(obj interface{}) {
+	_ = h.Sync(nil, obj)
+}
+
+// Update handles updates to ATSCachingPolicy resources
+func (h *AtsCacheHandler) Update(oldObj, newObj interface{}) {
+	_ = h.Sync(oldObj, newObj)
+}
+
+// Delete handles deletion of ATSCachingPolicy resources
+func (h *AtsCacheHandler) Delete(obj interface{}) {
+	_ = h.Sync(obj, nil)
+}
+
+// Sync for Syncer
+func (h *AtsCacheHandler) Sync(prev, cur interface{}) error {
+	switch {
+	case prev == nil:
+		return h.add(cur)
+	case cur == nil:
+		return h.delete(prev)
+	default:
+		return h.update(prev, cur)
+	}
+}
+
+func (h *AtsCacheHandler) add(obj interface{}) error {
 	u := obj.(*unstructured.Unstructured)
 	log.Printf("[ADD] ATSCachingPolicy: %s/%s", u.GetNamespace(), u.GetName())
 
 	rules, found, err := unstructured.NestedSlice(u.Object, "spec", "rules")
 	if err != nil || !found {
 		log.Printf("Add: rules not found or error occurred: %v", err)
-		return
+		return nil
 	}
 
 	var lines []string
@@ -73,38 +100,49 @@ func (h *AtsCacheHandler) Add(obj interface{}) {
 	}
 
 	configPath := h.CachePath
+	// an add that is retried must not repeat the lines it already wrote
+	existing := make(map[string]bool)
+	if existingData, err := os.ReadFile(configPath); err == nil {
+		for _, line := range strings.Split(string(existingData), "\n") {
+			existing[line] = true
+		}
+	}
+
 	f, err := os.OpenFile(configPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Printf("Add: Failed to open cache.config: %v", err)
-		return
+		return err
 	}
 	defer func() { _ = f.Close() }()
 
 	for _, line := range lines {
+		if existing[line] {
+			continue
+		}
 		if _, err := f.WriteString(line + "\n"); err != nil {
 			log.Printf("Add: Failed to write line to cache.config: %v", err)
+			return err
 		}
 	}
 
-	h.UpdateAts()
+	return h.UpdateAts()
 }
 
-// Update handles updates to ATSCachingPolicy resources
-func (h *AtsCacheHandler) Update(oldObj, newObj interface{}) {
+func (h *AtsCacheHandler) update(oldObj, newObj interface{}) error {
 	newU := newObj.(*unstructured.Unstructured)
 	log.Printf("[UPDATE] ATSCachingPolicy: %s/%s", newU.GetNamespace(), newU.GetName())
 
 	newRules, found, err := unstructured.NestedSlice(newU.Object, "spec", "rules")
 	if err != nil || !found {
 		log.Printf("Update: rules not found or error occurred: %v", err)
-		return
+		return nil
 	}
 
 	configPath := h.CachePath
 	existingData, err := os.ReadFile(configPath)
 	if err != nil {
 		log.Printf("Update: Failed to read cache.config: %v", err)
-		return
+		return err
 	}
 	lines := strings.Split(string(existingData), "\n")
 
@@ -138,12 +176,12 @@ func (h *AtsCacheHandler) Update(oldObj, newObj interface{}) {
 	err = os.WriteFile(configPath, []byte(strings.Join(lines, "\n")), 0644)
 	if err != nil {
 		log.Printf("Update: Failed to write updated cache.config: %v", err)
+		return err
 	}
-	h.UpdateAts()
+	return h.UpdateAts()
 }
 
-// Delete handles deletion of ATSCachingPolicy resources
-func (h *AtsCacheHandler) Delete(obj interface{}) {
+func (h *AtsCacheHandler) delete(obj interface{}) error {
 	u := obj.(*unstructured.Unstructured)
 	log.Printf("[DELETE] ATSCachingPolicy: %s/%s", u.GetNamespace(), u.GetName())
 
@@ -151,14 +189,14 @@ func (h *AtsCacheHandler) Delete(obj interface{}) {
 	existingData, err := os.ReadFile(configPath)
 	if err != nil {
 		log.Printf("Delete: Failed to read cache.config: %v", err)
-		return
+		return err
 	}
 	lines := strings.Split(string(existingData), "\n")
 
 	rules, found, err := unstructured.NestedSlice(u.Object, "spec", "rules")
 	if err != nil || !found {
 		log.Printf("Delete: rules not found or error occurred: %v", err)
-		return
+		return nil
 	}
 
 	patternsToDelete := make(map[string]string)
@@ -198,7 +236,13 @@ func (h *AtsCacheHandler) Delete(obj interface{}) {
 	err = os.WriteFile(configPath, []byte(strings.Join(updatedLines, "\n")), 0644)
 	if err != nil {
 		log.Printf("Delete: Failed to write updated cache.config: %v", err)
+		return err
 	}
 
-	h.UpdateAts()
+	return h.UpdateAts()
+}
+
+// GetResourceName returns the resource name
+func (h *AtsCacheHandler) GetResourceName() string {
+	return h.ResourceName
 }
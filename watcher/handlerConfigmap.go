@@ -16,6 +16,7 @@
 package watcher
 
 import (
+	"errors"
 	"log"
 
 	"github.com/apache/trafficserver-ingress-controller/endpoint"
@@ -31,38 +32,50 @@ type CMHandler struct {
 
 // Add for EventHandler
 func (c *CMHandler) Add(obj interface{}) {
-	c.update(obj)
+	_ = c.update(obj)
 }
 
-func (c *CMHandler) update(newObj interface{}) {
+// Sync for Syncer
+func (c *CMHandler) Sync(prev, cur interface{}) error {
+	if cur == nil {
+		// do not handle delete events for now
+		return nil
+	}
+	return c.update(cur)
+}
+
+func (c *CMHandler) update(newObj interface{}) error {
 	cm, ok := newObj.(*v1.ConfigMap)
 	if !ok {
 		log.Println("In ConfigMapHandler Update; cannot cast to *v1.ConfigMap")
-		return
+		return nil
 	}
 
 	annotations := cm.GetAnnotations()
 	if val, ok := annotations["ats-configmap"]; ok {
 		if val != "true" {
-			return
+			return nil
 		}
 	} else {
-		return
+		return nil
 	}
 
+	var errs []error
 	for currKey, currVal := range cm.Data {
 		msg, err := c.Ep.ATSManager.ConfigSet(currKey, currVal) // update ATS
 		if err != nil {
 			log.Println(err)
+			errs = append(errs, err)
 		} else {
 			log.Println(msg)
 		}
 	}
+	return errors.Join(errs...)
 }
 
 // Update for EventHandler
 func (c *CMHandler) Update(obj, newObj interface{}) {
-	c.update(newObj)
+	_ = c.update(newObj)
 }
 
 // Delete for EventHandler
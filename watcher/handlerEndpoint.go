@@ -16,8 +16,10 @@
 package watcher
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"reflect"
 
 	"github.com/apache/trafficserver-ingress-controller/endpoint"
 	"github.com/apache/trafficserver-ingress-controller/util"
@@ -25,114 +27,187 @@ import (
 	v1 "k8s.io/api/core/v1"
 )
 
-// EpHandler implements EventHandler
+// EpHandler implements EventHandler and Syncer
 type EpHandler struct {
 	ResourceName string
 	Ep           *endpoint.Endpoint
+	// IgHandler re-syncs the Ingresses using named ports when the port
+	// names of the Endpoints change. It is optional.
+	IgHandler *IgHandler
 }
 
+// Add for EventHandler
 func (e *EpHandler) Add(obj interface{}) {
-	log.Printf("Endpoint ADD %#v \n", obj)
-	e.add(obj)
+	_ = e.Sync(nil, obj)
+}
+
+// Update for EventHandler
+func (e *EpHandler) Update(obj, newObj interface{}) {
+	_ = e.Sync(obj, newObj)
+}
+
+// Delete for EventHandler
+func (e *EpHandler) Delete(obj interface{}) {
+	_ = e.Sync(obj, nil)
+}
+
+// Sync for Syncer
+func (e *EpHandler) Sync(prev, cur interface{}) error {
+	var err error
+	switch {
+	case prev == nil:
+		log.Printf("Endpoint ADD %#v \n", cur)
+		err = e.add(cur)
+	case cur == nil:
+		log.Printf("Endpoint Delete: %#v \n", prev)
+		err = e.delete(prev)
+	default:
+		log.Printf("Endpoint Update Obj: %#v , newObj: %#v \n", prev, cur)
+		err = e.update(prev, cur)
+	}
+	if err == nil {
+		err = e.resyncPortNames(prev, cur)
+	}
 	e.Ep.RedisClient.PrintAllKeys()
+	return err
 }
 
-func (e *EpHandler) add(obj interface{}) {
+func (e *EpHandler) add(obj interface{}) error {
 	eps, ok := obj.(*v1.Endpoints)
 	if !ok {
 		log.Println("In Endpoint Add; cannot cast to *v1.Endpoints.")
-		return
+		return nil
 	}
-	podSvcName := eps.GetObjectMeta().GetName()
-	namespace := eps.GetNamespace()
 
-	if !e.Ep.NsManager.IncludeNamespace(namespace) {
+	if !e.Ep.NsManager.IncludeNamespace(eps.GetNamespace()) {
 		log.Println("Namespace not included")
-		return
+		return nil
 	}
 
-	for _, subset := range eps.Subsets {
-		for _, port := range subset.Ports {
-			portnum := fmt.Sprint(port.Port)
-			portname := port.Name
-			key := util.ConstructSvcPortString(namespace, podSvcName, portnum)
-			for _, addr := range subset.Addresses {
-				v := util.ConstructIPPortString(addr.IP, portnum, portname)
-				e.Ep.RedisClient.DefaultDBSAdd(key, v)
-			}
-		}
-
+	var errs []error
+	protocol := e.IgHandler.serviceProtocol(eps.GetNamespace(), eps.GetName())
+	for key, ipports := range endpointsMembers(eps, protocol) {
+		errs = append(errs, e.Ep.RedisClient.DefaultDBSReplace(key, ipports))
 	}
+	return errors.Join(errs...)
 }
 
-// Update for EventHandler
-func (e *EpHandler) Update(obj, newObj interface{}) {
-	log.Printf("Endpoint Update Obj: %#v , newObj: %#v \n", obj, newObj)
-	e.update(newObj)
-	e.Ep.RedisClient.PrintAllKeys()
-}
-
-func (e *EpHandler) update(obj interface{}) {
+// update replaces the DB 0 sets of the Endpoints with their ready addresses,
+// so that pods leaving the ready set stop receiving requests right away
+func (e *EpHandler) update(obj, newObj interface{}) error {
 	eps, ok := obj.(*v1.Endpoints)
 	if !ok {
 		log.Println("In Endpoint Update; cannot cast to *v1.Endpoints.")
-		return
+		return nil
+	}
+	newEps, ok := newObj.(*v1.Endpoints)
+	if !ok {
+		log.Println("In Endpoint Update; cannot cast to *v1.Endpoints.")
+		return nil
 	}
-	podSvcName := eps.GetObjectMeta().GetName()
-	namespace := eps.GetNamespace()
 
-	if !e.Ep.NsManager.IncludeNamespace(namespace) {
+	if !e.Ep.NsManager.IncludeNamespace(newEps.GetNamespace()) {
 		log.Println("Namespace not included")
-		return
+		return nil
 	}
 
-	for _, subset := range eps.Subsets {
-		for _, port := range subset.Ports {
-			portnum := fmt.Sprint(port.Port)
-			portname := port.Name
-			key := util.ConstructSvcPortString(namespace, podSvcName, portnum)
-			for _, addr := range subset.Addresses {
-				k := "temp_" + key
-				v := util.ConstructIPPortString(addr.IP, portnum, portname)
-				e.Ep.RedisClient.DefaultDBSAdd(k, v)
-			}
-			e.Ep.RedisClient.DefaultDBSUnionStore(key, "temp_"+key)
-			e.Ep.RedisClient.DefaultDBDel("temp_" + key)
+	var errs []error
+	members := endpointsMembers(newEps, e.IgHandler.serviceProtocol(newEps.GetNamespace(), newEps.GetName()))
+	for key := range endpointsMembers(eps, "") {
+		if _, ok := members[key]; !ok {
+			errs = append(errs, e.Ep.RedisClient.DefaultDBDel(key))
 		}
-
 	}
+	for key, ipports := range members {
+		errs = append(errs, e.Ep.RedisClient.DefaultDBSReplace(key, ipports))
+	}
+	return errors.Join(errs...)
 }
 
-// Delete for EventHandler
-func (e *EpHandler) Delete(obj interface{}) {
-	log.Printf("Endpoint Delete: %#v \n", obj)
-	e.delete(obj)
-	e.Ep.RedisClient.PrintAllKeys()
-}
-
-func (e *EpHandler) delete(obj interface{}) {
+func (e *EpHandler) delete(obj interface{}) error {
 	eps, ok := obj.(*v1.Endpoints)
 	if !ok {
 		log.Println("In Endpoint DELETE; cannot cast to *v1.Endpoints.")
-		return
+		return nil
 	}
-	podSvcName := eps.GetObjectMeta().GetName()
-	namespace := eps.GetNamespace()
 
-	if !e.Ep.NsManager.IncludeNamespace(namespace) {
+	if !e.Ep.NsManager.IncludeNamespace(eps.GetNamespace()) {
 		log.Println("Namespace not included")
-		return
+		return nil
 	}
 
+	var errs []error
+	for key := range endpointsMembers(eps, "") {
+		errs = append(errs, e.Ep.RedisClient.DefaultDBDel(key))
+	}
+	return errors.Join(errs...)
+}
+
+// endpointsMembers computes the DB 0 sets of Endpoints, keyed by port.
+// NotReadyAddresses are left out. protocol is the backend protocol annotated
+// on the Service, if any.
+func endpointsMembers(eps *v1.Endpoints, protocol string) map[string][]string {
+	members := make(map[string][]string)
+	podSvcName := eps.GetObjectMeta().GetName()
+	namespace := eps.GetNamespace()
+
 	for _, subset := range eps.Subsets {
 		for _, port := range subset.Ports {
 			portnum := fmt.Sprint(port.Port)
+			portname := port.Name
 			key := util.ConstructSvcPortString(namespace, podSvcName, portnum)
-			e.Ep.RedisClient.DefaultDBDel(key)
+			if _, ok := members[key]; !ok {
+				members[key] = []string{}
+			}
+			for _, addr := range subset.Addresses {
+				v := util.ConstructIPPortString(addr.IP, portnum, util.BackendProtocol(protocol, portname))
+				members[key] = append(members[key], v)
+			}
 		}
+	}
+	return members
+}
 
+// resyncPortNames re-syncs the Ingresses pointing at the Service of the
+// Endpoints if the port names map to other numbers from obj to newObj.
+// obj is nil on creation and newObj is nil on deletion.
+func (e *EpHandler) resyncPortNames(obj, newObj interface{}) error {
+	if e.IgHandler == nil {
+		return nil
+	}
+	eps, _ := obj.(*v1.Endpoints)
+	newEps, _ := newObj.(*v1.Endpoints)
+	if eps == nil && newEps == nil {
+		return nil
 	}
 
+	names, newNames := endpointsPortNames(eps), endpointsPortNames(newEps)
+	if reflect.DeepEqual(names, newNames) {
+		return nil
+	}
+
+	meta := newEps
+	if meta == nil {
+		meta = eps
+	}
+	if !e.Ep.NsManager.IncludeNamespace(meta.GetNamespace()) {
+		return nil
+	}
+
+	return e.IgHandler.resyncPortNames(meta.GetNamespace(), meta.GetName(), names, newNames)
+}
+
+// syncEndpoints rewrites the DB 0 sets of the Endpoints of a Service
+func (e *EpHandler) syncEndpoints(namespace, name string) error {
+	if e.IgHandler == nil || e.IgHandler.EpLister == nil {
+		return nil
+	}
+	eps, err := e.IgHandler.EpLister.Endpoints(namespace).Get(name)
+	if err != nil {
+		// the Endpoints sync when they show up
+		return nil
+	}
+	return e.add(eps)
 }
 
 // GetResourceName returns the resource name
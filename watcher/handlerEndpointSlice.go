@@ -0,0 +1,343 @@
+/*
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficserver-ingress-controller/endpoint"
+	"github.com/apache/trafficserver-ingress-controller/util"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+)
+
+// EpSliceHandler implements EventHandler. A Service can have many
+// EndpointSlices, so on every change the DB 0 sets of the Service are
+// recomputed from all of its slices.
+type EpSliceHandler struct {
+	ResourceName string
+	Ep           *endpoint.Endpoint
+	SliceLister  discoverylisters.EndpointSliceLister
+	// IgHandler re-syncs the Ingresses using named ports when the port
+	// names of the slices change. It is optional.
+	IgHandler *IgHandler
+	// DrainTimeout is how long terminating endpoints that are still serving
+	// stay routable, as long as the Service has no ready endpoint
+	DrainTimeout time.Duration
+	// Queue runs the re-syncs of the Services whose terminating endpoints
+	// leave their drain window. Without it, they wait for the next event.
+	Queue *Queue
+
+	mu sync.Mutex
+	// draining tracks since when endpoints have been terminating
+	draining map[string]time.Time
+	// now is the clock, replaced in tests
+	now func() time.Time
+}
+
+// Add for EventHandler
+func (e *EpSliceHandler) Add(obj interface{}) {
+	_ = e.Sync(nil, obj)
+}
+
+// Update for EventHandler
+func (e *EpSliceHandler) Update(obj, newObj interface{}) {
+	_ = e.Sync(obj, newObj)
+}
+
+// Delete for EventHandler
+func (e *EpSliceHandler) Delete(obj interface{}) {
+	_ = e.Sync(obj, nil)
+}
+
+// Sync for Syncer
+func (e *EpSliceHandler) Sync(prev, cur interface{}) error {
+	log.Printf("EndpointSlice Sync Obj: %#v , newObj: %#v \n", prev, cur)
+	slice, _ := prev.(*discoveryv1.EndpointSlice)
+	newSlice, _ := cur.(*discoveryv1.EndpointSlice)
+	if slice == nil && newSlice == nil {
+		log.Println("In EndpointSlice Sync; cannot cast to *discoveryv1.EndpointSlice.")
+		return nil
+	}
+	err := e.sync(slice, newSlice)
+	e.Ep.RedisClient.PrintAllKeys()
+	return err
+}
+
+// sync rewrites the DB 0 sets of the Service owning a slice that changed
+// from slice to newSlice. slice is nil on creation and newSlice is nil on
+// deletion. The lister is expected to already hold newSlice.
+func (e *EpSliceHandler) sync(slice, newSlice *discoveryv1.EndpointSlice) error {
+	meta := newSlice
+	if meta == nil {
+		meta = slice
+	}
+	namespace := meta.GetNamespace()
+	svcName := meta.GetLabels()[discoveryv1.LabelServiceName]
+	if svcName == "" {
+		return nil
+	}
+
+	if !e.Ep.NsManager.IncludeNamespace(namespace) {
+		log.Println("Namespace not included")
+		return nil
+	}
+
+	return e.syncService(namespace, svcName, slice, newSlice)
+}
+
+// syncService rewrites the DB 0 sets of a Service from its EndpointSlices
+func (e *EpSliceHandler) syncService(namespace, svcName string, slice, newSlice *discoveryv1.EndpointSlice) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	slices, err := e.SliceLister.EndpointSlices(namespace).List(serviceSelector(svcName))
+	if err != nil {
+		return fmt.Errorf("listing endpointslices of %s/%s failed: %v", namespace, svcName, err)
+	}
+
+	var errs []error
+	protocol := e.IgHandler.serviceProtocol(namespace, svcName)
+	members := sliceMembers(namespace, svcName, slices, e.drainer(namespace, svcName, slices), protocol)
+	// ports only found in the previous version of the slice are gone
+	if slice != nil {
+		for key := range sliceMembers(namespace, svcName, []*discoveryv1.EndpointSlice{slice}, nil, "") {
+			if _, ok := members[key]; !ok {
+				errs = append(errs, e.Ep.RedisClient.DefaultDBDel(key))
+			}
+		}
+	}
+	for key, ipports := range members {
+		errs = append(errs, e.Ep.RedisClient.DefaultDBSReplace(key, ipports))
+	}
+
+	if e.IgHandler != nil {
+		oldSlices := replaceSlice(slices, newSlice, slice)
+		names, newNames := slicePortNames(oldSlices), slicePortNames(slices)
+		if !reflect.DeepEqual(names, newNames) {
+			errs = append(errs, e.IgHandler.resyncPortNames(namespace, svcName, names, newNames))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// syncEndpoints rewrites the DB 0 sets of a Service
+func (e *EpSliceHandler) syncEndpoints(namespace, name string) error {
+	return e.syncService(namespace, name, nil, nil)
+}
+
+// members computes the DB 0 sets of every Service from the EndpointSlices
+// in the lister
+func (e *EpSliceHandler) members() (map[string][]string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	slices, err := e.SliceLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("listing endpointslices failed: %v", err)
+	}
+
+	type service struct{ namespace, name string }
+	services := make(map[service][]*discoveryv1.EndpointSlice)
+	for _, slice := range slices {
+		svc := service{slice.GetNamespace(), slice.GetLabels()[discoveryv1.LabelServiceName]}
+		if svc.name == "" || !e.Ep.NsManager.IncludeNamespace(svc.namespace) {
+			continue
+		}
+		services[svc] = append(services[svc], slice)
+	}
+
+	members := make(map[string][]string)
+	for svc, slices := range services {
+		protocol := e.IgHandler.serviceProtocol(svc.namespace, svc.name)
+		for key, ipports := range sliceMembers(svc.namespace, svc.name, slices, e.drainer(svc.namespace, svc.name, slices), protocol) {
+			members[key] = ipports
+		}
+	}
+	return members, nil
+}
+
+// drainer records when the terminating endpoints of a Service were first
+// seen and returns whether an address is still within its drain window. A
+// re-sync is scheduled for when the window closes.
+func (e *EpSliceHandler) drainer(namespace, svcName string, slices []*discoveryv1.EndpointSlice) func(addr string) bool {
+	if e.draining == nil {
+		e.draining = make(map[string]time.Time)
+	}
+	now := time.Now
+	if e.now != nil {
+		now = e.now
+	}
+
+	prefix := namespace + "/" + svcName + "/"
+	seen := make(map[string]bool)
+	for _, slice := range slices {
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Terminating == nil || !*ep.Conditions.Terminating {
+				continue
+			}
+			for _, addr := range ep.Addresses {
+				key := prefix + addr
+				seen[key] = true
+				if _, ok := e.draining[key]; !ok {
+					e.draining[key] = now()
+					if e.DrainTimeout > 0 && e.Queue != nil {
+						e.Queue.AddAfter(drainSyncer{e}, namespace+"/"+svcName, namespace+"/"+svcName, e.DrainTimeout)
+					}
+				}
+			}
+		}
+	}
+	for key := range e.draining {
+		if strings.HasPrefix(key, prefix) && !seen[key] {
+			delete(e.draining, key)
+		}
+	}
+
+	return func(addr string) bool {
+		since, ok := e.draining[prefix+addr]
+		return ok && now().Sub(since) < e.DrainTimeout
+	}
+}
+
+// GetResourceName returns the resource name
+func (e *EpSliceHandler) GetResourceName() string {
+	return e.ResourceName
+}
+
+// drainSyncer re-syncs the DB 0 sets of the Service "namespace/name" it is
+// given, once terminating endpoints leave their drain window
+type drainSyncer struct {
+	e *EpSliceHandler
+}
+
+// Sync for Syncer
+func (d drainSyncer) Sync(_, cur interface{}) error {
+	svc, ok := cur.(string)
+	if !ok {
+		return nil
+	}
+	namespace, name, _ := strings.Cut(svc, "/")
+	return d.e.syncEndpoints(namespace, name)
+}
+
+// GetResourceName returns the resource name
+func (d drainSyncer) GetResourceName() string {
+	return d.e.ResourceName + "-drain"
+}
+
+// sliceMembers merges the EndpointSlices of a Service into the DB 0 sets,
+// keyed by port. Ready endpoints are used. Should a port have none, the
+// endpoints that are still serving while terminating, and for which
+// draining returns true, are used instead, so that a rollout of every pod
+// does not drop traffic. protocol is the backend protocol annotated on the
+// Service, if any.
+func sliceMembers(namespace, svcName string, slices []*discoveryv1.EndpointSlice, draining func(addr string) bool, protocol string) map[string][]string {
+	ready := make(map[string][]string)
+	serving := make(map[string][]string)
+
+	for _, slice := range slices {
+		if slice.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+		for _, port := range slice.Ports {
+			if port.Port == nil {
+				continue
+			}
+			portnum := fmt.Sprint(*port.Port)
+			portname := ""
+			if port.Name != nil {
+				portname = *port.Name
+			}
+			key := util.ConstructSvcPortString(namespace, svcName, portnum)
+			if _, ok := ready[key]; !ok {
+				ready[key] = []string{}
+			}
+
+			for _, ep := range slice.Endpoints {
+				cond := ep.Conditions
+				for _, addr := range ep.Addresses {
+					v := util.ConstructIPPortString(addr, portnum, util.BackendProtocol(protocol, portname))
+					switch {
+					// a nil ready condition is to be read as ready
+					case cond.Ready == nil || *cond.Ready:
+						ready[key] = append(ready[key], v)
+					case cond.Serving != nil && *cond.Serving && cond.Terminating != nil && *cond.Terminating &&
+						draining != nil && draining(addr):
+						serving[key] = append(serving[key], v)
+					}
+				}
+			}
+		}
+	}
+
+	for key, ipports := range ready {
+		if len(ipports) == 0 {
+			ready[key] = serving[key]
+		}
+	}
+	return ready
+}
+
+// slicePortNames maps the port names of EndpointSlices to their numbers.
+// Should slices disagree on a number, the lowest one is used.
+func slicePortNames(slices []*discoveryv1.EndpointSlice) map[string]string {
+	nums := make(map[string]int32)
+	for _, slice := range slices {
+		for _, port := range slice.Ports {
+			if port.Port == nil {
+				continue
+			}
+			name := ""
+			if port.Name != nil {
+				name = *port.Name
+			}
+			if num, ok := nums[name]; !ok || *port.Port < num {
+				nums[name] = *port.Port
+			}
+		}
+	}
+	return portNumbers(nums)
+}
+
+// replaceSlice returns slices with cur swapped for prev. A nil cur means
+// prev was deleted, and a nil prev means cur was created.
+func replaceSlice(slices []*discoveryv1.EndpointSlice, cur, prev *discoveryv1.EndpointSlice) []*discoveryv1.EndpointSlice {
+	res := make([]*discoveryv1.EndpointSlice, 0, len(slices)+1)
+	for _, slice := range slices {
+		if cur != nil && slice.GetName() == cur.GetName() {
+			continue
+		}
+		res = append(res, slice)
+	}
+	if prev != nil {
+		res = append(res, prev)
+	}
+	return res
+}
+
+// serviceSelector selects the EndpointSlices of a Service
+func serviceSelector(svcName string) labels.Selector {
+	return labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: svcName})
+}
@@ -0,0 +1,257 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apache/trafficserver-ingress-controller/util"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+)
+
+func TestAdd_MergeEndpointSlices(t *testing.T) {
+	sliceHandler, indexer := createExampleEpSliceHandler()
+	slice := createExampleEndpointSlice("testsvc-abc", "10.10.1.1")
+	slice2 := createExampleEndpointSlice("testsvc-def", "10.10.2.2")
+
+	_ = indexer.Add(&slice)
+	sliceHandler.Add(&slice)
+	_ = indexer.Add(&slice2)
+	sliceHandler.Add(&slice2)
+
+	returnedKeys := sliceHandler.Ep.RedisClient.GetDefaultDBKeyValues()
+
+	expectedKeys := getExpectedKeysForEndpointAdd()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestUpdate_EndpointSliceNotReady(t *testing.T) {
+	sliceHandler, indexer := createExampleEpSliceHandler()
+	slice := createExampleEndpointSlice("testsvc-abc", "10.10.1.1", "10.10.2.2")
+
+	_ = indexer.Add(&slice)
+	sliceHandler.Add(&slice)
+
+	newSlice := createExampleEndpointSlice("testsvc-abc", "10.10.1.1", "10.10.2.2")
+	newSlice.Endpoints[0].Conditions.Ready = boolPtr(false)
+	_ = indexer.Update(&newSlice)
+	sliceHandler.Update(&slice, &newSlice)
+
+	returnedKeys := sliceHandler.Ep.RedisClient.GetDefaultDBKeyValues()
+
+	expectedKeys := make(map[string][]string)
+	expectedKeys["trafficserver-test-2:testsvc:8080"] = []string{"10.10.2.2#8080#http"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestUpdate_EndpointSliceServingTerminating(t *testing.T) {
+	sliceHandler, indexer := createExampleEpSliceHandler()
+	slice := createExampleEndpointSlice("testsvc-abc", "10.10.1.1", "10.10.2.2")
+
+	_ = indexer.Add(&slice)
+	sliceHandler.Add(&slice)
+
+	newSlice := createExampleEndpointSlice("testsvc-abc", "10.10.1.1", "10.10.2.2")
+	for i := range newSlice.Endpoints {
+		newSlice.Endpoints[i].Conditions.Ready = boolPtr(false)
+		newSlice.Endpoints[i].Conditions.Terminating = boolPtr(true)
+	}
+	newSlice.Endpoints[0].Conditions.Serving = boolPtr(true)
+	_ = indexer.Update(&newSlice)
+	sliceHandler.Update(&slice, &newSlice)
+
+	returnedKeys := sliceHandler.Ep.RedisClient.GetDefaultDBKeyValues()
+
+	expectedKeys := make(map[string][]string)
+	expectedKeys["trafficserver-test-2:testsvc:8080"] = []string{"10.10.1.1#8080#http"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestUpdate_EndpointSliceDrainTimeout(t *testing.T) {
+	sliceHandler, indexer := createExampleEpSliceHandler()
+	now := time.Now()
+	sliceHandler.now = func() time.Time { return now }
+
+	slice := createExampleEndpointSlice("testsvc-abc", "10.10.1.1")
+	slice.Endpoints[0].Conditions = discoveryv1.EndpointConditions{
+		Ready:       boolPtr(false),
+		Serving:     boolPtr(true),
+		Terminating: boolPtr(true),
+	}
+	_ = indexer.Add(&slice)
+	sliceHandler.Add(&slice)
+
+	returnedKeys := sliceHandler.Ep.RedisClient.GetDefaultDBKeyValues()
+
+	expectedKeys := make(map[string][]string)
+	expectedKeys["trafficserver-test-2:testsvc:8080"] = []string{"10.10.1.1#8080#http"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+
+	now = now.Add(time.Minute)
+	sliceHandler.syncService("trafficserver-test-2", "testsvc", nil, nil)
+
+	returnedKeys = sliceHandler.Ep.RedisClient.GetDefaultDBKeyValues()
+
+	if len(returnedKeys) != 0 {
+		t.Errorf("returned \n%v,  but expected no keys", returnedKeys)
+	}
+}
+
+func TestUpdate_EndpointSliceDrainResync(t *testing.T) {
+	sliceHandler, indexer := createExampleEpSliceHandler()
+	sliceHandler.DrainTimeout = 50 * time.Millisecond
+	sliceHandler.Queue = NewQueue("test")
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go sliceHandler.Queue.Run(stopChan)
+
+	slice := createExampleEndpointSlice("testsvc-abc", "10.10.1.1")
+	slice.Endpoints[0].Conditions = discoveryv1.EndpointConditions{
+		Ready:       boolPtr(false),
+		Serving:     boolPtr(true),
+		Terminating: boolPtr(true),
+	}
+	_ = indexer.Add(&slice)
+	sliceHandler.Add(&slice)
+
+	// the queue re-syncs the service once the drain window closes
+	waitFor(t, func() bool { return len(sliceHandler.Ep.RedisClient.GetDefaultDBKeyValues()) == 0 })
+}
+
+func TestUpdate_EndpointSlicePortNumber(t *testing.T) {
+	sliceHandler, indexer := createExampleEpSliceHandler()
+	slice := createExampleEndpointSlice("testsvc-abc", "10.10.1.1", "10.10.2.2")
+
+	_ = indexer.Add(&slice)
+	sliceHandler.Add(&slice)
+
+	newSlice := createExampleEndpointSlice("testsvc-abc", "10.10.1.1", "10.10.2.2")
+	newSlice.Ports[0].Port = int32Ptr(8081)
+	_ = indexer.Update(&newSlice)
+	sliceHandler.Update(&slice, &newSlice)
+
+	returnedKeys := sliceHandler.Ep.RedisClient.GetDefaultDBKeyValues()
+
+	expectedKeys := make(map[string][]string)
+	expectedKeys["trafficserver-test-2:testsvc:8081"] = []string{"10.10.1.1#8081#http", "10.10.2.2#8081#http"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestDelete_EndpointSlice(t *testing.T) {
+	sliceHandler, indexer := createExampleEpSliceHandler()
+	slice := createExampleEndpointSlice("testsvc-abc", "10.10.1.1")
+	slice2 := createExampleEndpointSlice("testsvc-def", "10.10.2.2")
+
+	_ = indexer.Add(&slice)
+	sliceHandler.Add(&slice)
+	_ = indexer.Add(&slice2)
+	sliceHandler.Add(&slice2)
+
+	_ = indexer.Delete(&slice)
+	sliceHandler.Delete(&slice)
+
+	returnedKeys := sliceHandler.Ep.RedisClient.GetDefaultDBKeyValues()
+
+	expectedKeys := make(map[string][]string)
+	expectedKeys["trafficserver-test-2:testsvc:8080"] = []string{"10.10.2.2#8080#http"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+
+	_ = indexer.Delete(&slice2)
+	sliceHandler.Delete(&slice2)
+
+	returnedKeys = sliceHandler.Ep.RedisClient.GetDefaultDBKeyValues()
+
+	if len(returnedKeys) != 0 {
+		t.Errorf("returned \n%v,  but expected no keys", returnedKeys)
+	}
+}
+
+func createExampleEpSliceHandler() (*EpSliceHandler, cache.Indexer) {
+	exampleEndpoint := createExampleEndpoint()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	sliceHandler := &EpSliceHandler{
+		ResourceName: "endpointslices",
+		Ep:           &exampleEndpoint,
+		SliceLister:  discoverylisters.NewEndpointSliceLister(indexer),
+		DrainTimeout: time.Minute,
+	}
+
+	return sliceHandler, indexer
+}
+
+func createExampleEndpointSlice(name string, ips ...string) discoveryv1.EndpointSlice {
+	exampleSlice := discoveryv1.EndpointSlice{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      name,
+			Namespace: "trafficserver-test-2",
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: "testsvc",
+			},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports: []discoveryv1.EndpointPort{
+			{
+				Name: stringPtr("main"),
+				Port: int32Ptr(8080),
+			},
+		},
+	}
+
+	for _, ip := range ips {
+		exampleSlice.Endpoints = append(exampleSlice.Endpoints, discoveryv1.Endpoint{
+			Addresses: []string{ip},
+			Conditions: discoveryv1.EndpointConditions{
+				Ready: boolPtr(true),
+			},
+		})
+	}
+
+	return exampleSlice
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -18,7 +18,13 @@ import (
 	"testing"
 
 	v1 "k8s.io/api/core/v1"
+	nv1 "k8s.io/api/networking/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+
+	corelisters "k8s.io/client-go/listers/core/v1"
+	netlisters "k8s.io/client-go/listers/networking/v1"
 )
 
 func TestAdd_BasicEndpoint(t *testing.T) {
@@ -58,10 +64,11 @@ func TestUpdate_UpdateAddress(t *testing.T) {
 	exampleV1Endpoint := createExampleV1Endpoint()
 
 	epHandler.add(&exampleV1Endpoint)
+	oldV1Endpoint := exampleV1Endpoint.DeepCopy()
 
 	exampleV1Endpoint.Subsets[0].Addresses[0].IP = "10.10.3.3"
 
-	epHandler.update(&exampleV1Endpoint)
+	epHandler.update(oldV1Endpoint, &exampleV1Endpoint)
 
 	returnedKeys := epHandler.Ep.RedisClient.GetDefaultDBKeyValues()
 
@@ -77,14 +84,15 @@ func TestUpdate_UpdatePortNumber(t *testing.T) {
 	exampleV1Endpoint := createExampleV1Endpoint()
 
 	epHandler.add(&exampleV1Endpoint)
+	oldV1Endpoint := exampleV1Endpoint.DeepCopy()
 
 	exampleV1Endpoint.Subsets[0].Ports[0].Port = 8081
 
-	epHandler.update(&exampleV1Endpoint)
+	epHandler.update(oldV1Endpoint, &exampleV1Endpoint)
 
 	returnedKeys := epHandler.Ep.RedisClient.GetDefaultDBKeyValues()
 
-	expectedKeys := getExpectedKeysForEndpointAdd()
+	expectedKeys := make(map[string][]string)
 	expectedKeys["trafficserver-test-2:testsvc:8081"] = make([]string, 2)
 	expectedKeys["trafficserver-test-2:testsvc:8081"][0] = "10.10.2.2#8081#http"
 	expectedKeys["trafficserver-test-2:testsvc:8081"][1] = "10.10.1.1#8081#http"
@@ -99,10 +107,11 @@ func TestUpdate_UpdatePortName(t *testing.T) {
 	exampleV1Endpoint := createExampleV1Endpoint()
 
 	epHandler.add(&exampleV1Endpoint)
+	oldV1Endpoint := exampleV1Endpoint.DeepCopy()
 
 	exampleV1Endpoint.Subsets[0].Ports[0].Name = "https"
 
-	epHandler.update(&exampleV1Endpoint)
+	epHandler.update(oldV1Endpoint, &exampleV1Endpoint)
 
 	returnedKeys := epHandler.Ep.RedisClient.GetDefaultDBKeyValues()
 
@@ -121,15 +130,17 @@ func TestUpdate_UpdateEndpointName(t *testing.T) {
 	exampleV1Endpoint := createExampleV1Endpoint()
 
 	epHandler.add(&exampleV1Endpoint)
+	oldV1Endpoint := exampleV1Endpoint.DeepCopy()
 
 	exampleV1Endpoint.ObjectMeta.Name = "testsvc-modified"
 
-	epHandler.update(&exampleV1Endpoint)
+	epHandler.update(oldV1Endpoint, &exampleV1Endpoint)
 
 	returnedKeys := epHandler.Ep.RedisClient.GetDefaultDBKeyValues()
 
 	expectedKeys := getExpectedKeysForEndpointAdd()
 	expectedKeys["trafficserver-test-2:testsvc-modified:8080"] = expectedKeys["trafficserver-test-2:testsvc:8080"]
+	delete(expectedKeys, "trafficserver-test-2:testsvc:8080")
 
 	if !util.IsSameMap(returnedKeys, expectedKeys) {
 		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
@@ -157,10 +168,11 @@ func TestUpdate_DeleteAddress(t *testing.T) {
 	exampleV1Endpoint := createExampleV1Endpoint()
 
 	epHandler.add(&exampleV1Endpoint)
+	oldV1Endpoint := exampleV1Endpoint.DeepCopy()
 
 	exampleV1Endpoint.Subsets[0].Addresses = exampleV1Endpoint.Subsets[0].Addresses[:1]
 
-	epHandler.update(&exampleV1Endpoint)
+	epHandler.update(oldV1Endpoint, &exampleV1Endpoint)
 
 	returnedKeys := epHandler.Ep.RedisClient.GetDefaultDBKeyValues()
 
@@ -172,17 +184,40 @@ func TestUpdate_DeleteAddress(t *testing.T) {
 	}
 }
 
+func TestUpdate_AddressNotReady(t *testing.T) {
+	epHandler := createExampleEpHandler()
+	exampleV1Endpoint := createExampleV1Endpoint()
+
+	epHandler.add(&exampleV1Endpoint)
+	oldV1Endpoint := exampleV1Endpoint.DeepCopy()
+
+	exampleV1Endpoint.Subsets[0].NotReadyAddresses = exampleV1Endpoint.Subsets[0].Addresses[1:]
+	exampleV1Endpoint.Subsets[0].Addresses = exampleV1Endpoint.Subsets[0].Addresses[:1]
+
+	epHandler.update(oldV1Endpoint, &exampleV1Endpoint)
+
+	returnedKeys := epHandler.Ep.RedisClient.GetDefaultDBKeyValues()
+
+	expectedKeys := make(map[string][]string)
+	expectedKeys["trafficserver-test-2:testsvc:8080"] = []string{"10.10.1.1#8080#http"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
 func TestUpdate_AddAddress(t *testing.T) {
 	epHandler := createExampleEpHandler()
 	exampleV1Endpoint := createExampleV1Endpoint()
 
 	epHandler.add(&exampleV1Endpoint)
+	oldV1Endpoint := exampleV1Endpoint.DeepCopy()
 
 	exampleV1Endpoint.Subsets[0].Addresses = append(exampleV1Endpoint.Subsets[0].Addresses, v1.EndpointAddress{
 		IP: "10.10.3.3",
 	})
 
-	epHandler.update(&exampleV1Endpoint)
+	epHandler.update(oldV1Endpoint, &exampleV1Endpoint)
 
 	returnedKeys := epHandler.Ep.RedisClient.GetDefaultDBKeyValues()
 
@@ -224,9 +259,98 @@ func createExampleV1Endpoint() v1.Endpoints {
 	return exampleEndpoint
 }
 
+func TestUpdate_PortNameResyncsIngress(t *testing.T) {
+	epHandler := createExampleEpHandler()
+	igHandler := createExampleIgHandler()
+	igHandler.Ep = epHandler.Ep
+	epHandler.IgHandler = &igHandler
+
+	exampleIngress := createExampleIngress()
+	exampleIngress.Spec.Rules[0].IngressRuleValue.HTTP.Paths[1].Backend.Service.Port = nv1.ServiceBackendPort{Name: "main"}
+
+	igIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	_ = igIndexer.Add(&exampleIngress)
+	igHandler.IgLister = netlisters.NewIngressLister(igIndexer)
+
+	eps := createExampleBackendEndpoints("appsvc2", "main", 9443)
+	epLister, epIndexer := createExampleEndpointsLister(&eps)
+	igHandler.EpLister = epLister
+
+	igHandler.add(&exampleIngress)
+
+	newEps := createExampleBackendEndpoints("appsvc2", "main", 9444)
+	_ = epIndexer.Update(&newEps)
+	epHandler.Update(&eps, &newEps)
+
+	returnedKeys := epHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+http://test.media.com/app2"] = []string{"trafficserver-test:appsvc2:9444"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_BackendProtocolOfService(t *testing.T) {
+	epHandler := createExampleEpHandler()
+	igHandler := createExampleIgHandler()
+	epHandler.IgHandler = &igHandler
+
+	svc := createExampleService("appsvc1", 8080, intstr.FromInt(8080))
+	svc.Annotations = map[string]string{util.AnnotationBackendProtocol: "GRPC"}
+	igHandler.SvcLister, _ = createExampleServiceLister(&svc)
+
+	eps := createExampleBackendEndpoints("appsvc1", "https", 8080)
+	epHandler.Add(&eps)
+
+	returnedKeys := epHandler.Ep.RedisClient.GetDefaultDBKeyValues()
+
+	expectedKeys := map[string][]string{"trafficserver-test:appsvc1:8080": {"10.10.1.1#8080#grpc"}}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func createExampleBackendEndpoints(name, portName string, port int32) v1.Endpoints {
+	exampleEndpoint := v1.Endpoints{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      name,
+			Namespace: "trafficserver-test",
+		},
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{
+						IP: "10.10.1.1",
+					},
+				},
+				Ports: []v1.EndpointPort{
+					{
+						Name:     portName,
+						Port:     port,
+						Protocol: "TCP",
+					},
+				},
+			},
+		},
+	}
+
+	return exampleEndpoint
+}
+
+func createExampleEndpointsLister(eps ...*v1.Endpoints) (corelisters.EndpointsLister, cache.Indexer) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, e := range eps {
+		_ = indexer.Add(e)
+	}
+	return corelisters.NewEndpointsLister(indexer), indexer
+}
+
 func createExampleEpHandler() EpHandler {
 	exampleEndpoint := createExampleEndpoint()
-	epHandler := EpHandler{"endpoints", &exampleEndpoint}
+	epHandler := EpHandler{ResourceName: "endpoints", Ep: &exampleEndpoint}
 
 	return epHandler
 }
@@ -16,416 +16,878 @@
 package watcher
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"strconv"
+	"strings"
 
 	"github.com/apache/trafficserver-ingress-controller/endpoint"
 	"github.com/apache/trafficserver-ingress-controller/util"
 
+	v1 "k8s.io/api/core/v1"
 	nv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	netlisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 // IgHandler implements EventHandler
 type IgHandler struct {
 	ResourceName string
 	Ep           *endpoint.Endpoint
+	// SvcLister is used to translate backend ports to Service targetPorts.
+	// Without it, backend port numbers are used as they are.
+	SvcLister corelisters.ServiceLister
+	// EpLister is used to resolve named ports through the Endpoints
+	EpLister corelisters.EndpointsLister
+	// SliceLister replaces EpLister when EndpointSlices are watched instead
+	SliceLister discoverylisters.EndpointSliceLister
+	// IgLister is used to find the Ingresses to re-sync when a Service or
+	// its Endpoints change
+	IgLister netlisters.IngressLister
+	// ClassLister resolves the IngressClass of an Ingress. Without it, only
+	// the static class of the ATSManager is compared against.
+	ClassLister netlisters.IngressClassLister
+	// Controller is the spec.controller of the IngressClasses served
+	Controller string
+	// ClassAnnotation accepts the Ingresses whose class is only given by
+	// the legacy kubernetes.io/ingress.class annotation
+	ClassAnnotation bool
+	// SSLRedirect redirects plain http requests for the TLS hosts of the
+	// Ingresses to https, unless their ssl-redirect annotation says not to
+	SSLRedirect bool
+	// CertDir is where the TLSManager writes the certificates of Secrets.
+	// The proxy-ssl annotations are ignored when it is empty.
+	CertDir string
+	// Snippets writes the server-snippets of the Ingresses to Redis
+	Snippets bool
+	// SnippetNamespaces are the namespaces whose Ingresses may have
+	// snippets. Every namespace may when it is nil.
+	SnippetNamespaces map[string]bool
+	// Recorder reports the snippets rejected as Events of their Ingresses
+	Recorder record.EventRecorder
 }
 
+// hostPathRoute is a single member of a host/path set in DB One
+type hostPathRoute struct {
+	hostPath string
+	member   string
+}
+
+// backendLookup returns the Service with the given name, nil if unknown,
+// and the numbers of its named endpoint ports
+type backendLookup func(namespace, name string) (*v1.Service, map[string]string)
+
+// Add for EventHandler
 func (g *IgHandler) Add(obj interface{}) {
-	log.Printf("In INGRESS_HANDLER ADD %#v \n", obj)
-	g.add(obj)
+	_ = g.Sync(nil, obj)
+}
+
+// Update for EventHandler
+func (g *IgHandler) Update(obj, newObj interface{}) {
+	_ = g.Sync(obj, newObj)
+}
+
+// Delete for EventHandler
+func (g *IgHandler) Delete(obj interface{}) {
+	_ = g.Sync(obj, nil)
+}
+
+// Sync for Syncer
+func (g *IgHandler) Sync(prev, cur interface{}) error {
+	var err error
+	switch {
+	case prev == nil:
+		log.Printf("In INGRESS_HANDLER ADD %#v \n", cur)
+		err = g.add(cur)
+	case cur == nil:
+		log.Printf("In INGRESS_HANDLER DELETE %#v \n", prev)
+		err = g.delete(prev)
+	default:
+		log.Printf("In INGRESS_HANDLER UPDATE %#v \n", cur)
+		err = g.update(prev, cur)
+	}
 	g.Ep.RedisClient.PrintAllKeys()
+	return err
 }
 
-func (g *IgHandler) add(obj interface{}) {
+func (g *IgHandler) add(obj interface{}) error {
 	ingressObj, ok := obj.(*nv1.Ingress)
 	if !ok {
 		log.Println("In HandlerIngress Add; cannot cast to *nv1.Ingress")
-		return
+		return nil
 	}
 
-	namespace := ingressObj.GetNamespace()
-	// v1.18 ingress class name field in ingress object
-	//ingressClass, _ := util.ExtractIngressClass(ingressObj.GetAnnotations())
-	ingressClass, _ := util.ExtractIngressClassName(obj)
-	if !g.Ep.NsManager.IncludeNamespace(namespace) || !g.Ep.ATSManager.IncludeIngressClass(ingressClass) {
+	if !g.includeIngress(ingressObj) {
 		log.Println("Namespace not included or Ingress Class not matched")
-		return
+		return nil
 	}
+	return g.install(ingressObj)
+}
 
-	name := ingressObj.GetName()
-	version := ingressObj.GetResourceVersion()
-	nameversion := util.ConstructNameVersionString(namespace, name, version)
-
-	// add the script before adding route
-	snippet, snippetErr := util.ExtractServerSnippet(ingressObj.GetAnnotations())
-	if snippetErr == nil {
-		log.Println("Snippet in the handlerIngress.go file: ", snippet)
-		g.Ep.RedisClient.DBOneSAdd(nameversion, snippet)
+// update moves the routes of an Ingress according to whether the controller
+// owns its old and new versions. An Ingress that starts being owned, e.g.
+// when moved to a class of the controller, has its routes fully installed,
+// and one that stops being owned has them fully removed.
+func (g *IgHandler) update(obj, newObj interface{}) error {
+	ingressObj, ok := obj.(*nv1.Ingress)
+	if !ok {
+		log.Println("In HandlerIngress Update; cannot cast to *nv1.Ingress")
+		return nil
 	}
 
-	// add default backend rules
-	if ingressObj.Spec.DefaultBackend != nil {
-		host := "*"
-		scheme := "http"
-		path := "/"
-		pathType := nv1.PathTypePrefix
-		hostPath := util.ConstructHostPathString(scheme, host, path, pathType)
-		service := ingressObj.Spec.DefaultBackend.Service.Name
-		port := strconv.Itoa(int(ingressObj.Spec.DefaultBackend.Service.Port.Number))
-		svcport := util.ConstructSvcPortString(namespace, service, port)
+	newIngressObj, ok := newObj.(*nv1.Ingress)
+	if !ok {
+		log.Println("In HandlerIngress Update; cannot cast to *nv1.Ingress")
+		return nil
+	}
 
-		g.Ep.RedisClient.DBOneSAdd(hostPath, svcport)
+	owned, newOwned := g.includeIngress(ingressObj), g.includeIngress(newIngressObj)
+	switch {
+	case !owned && !newOwned:
+		log.Println("Namespace not included or Ingress Class not matched")
+		return nil
+	case !owned:
+		log.Println("Ingress now owned; installing its routes")
+		return g.install(newIngressObj)
+	case !newOwned:
+		log.Println("Ingress no longer owned; removing its routes")
+		return g.uninstall(ingressObj)
+	}
 
-		if snippetErr == nil {
-			g.Ep.RedisClient.DBOneSAdd(hostPath, nameversion)
-		}
+	var errs []error
 
-		// add default backend rule for https as well
-		scheme = "https"
-		hostPath = util.ConstructHostPathString(scheme, host, path, pathType)
+	g.reportAnnotations(ingressObj, newIngressObj)
 
-		g.Ep.RedisClient.DBOneSAdd(hostPath, svcport)
+	newSnippet, ok, err := g.snippet(newIngressObj)
+	if ok {
+		errs = append(errs, g.Ep.RedisClient.DBOneSAdd(nameVersion(newIngressObj), newSnippet))
+	} else if err != nil && ingressObj.GetAnnotations()[util.AnnotationServerSnippet] != newIngressObj.GetAnnotations()[util.AnnotationServerSnippet] {
+		g.rejectSnippet(newIngressObj, err)
+	}
 
-		if snippetErr == nil {
-			g.Ep.RedisClient.DBOneSAdd(hostPath, nameversion)
+	// the routes of both versions are removed only once the new ones are in
+	newRoutes := g.routes(newIngressObj, g.getBackend)
+	kept := make(map[hostPathRoute]bool, len(newRoutes))
+	for _, r := range newRoutes {
+		kept[r] = true
+		errs = append(errs, g.Ep.RedisClient.DBOneSAdd(r.hostPath, r.member))
+	}
+	for _, r := range g.routes(ingressObj, g.getBackend) {
+		if !kept[r] {
+			errs = append(errs, g.Ep.RedisClient.DBOneSRem(r.hostPath, r.member))
 		}
 	}
 
-	tlsHosts := make(map[string]string)
+	g.flagConflicts(newIngressObj, newRoutes)
 
-	for _, ingressTLS := range ingressObj.Spec.TLS {
-		for _, tlsHost := range ingressTLS.Hosts {
-			tlsHosts[tlsHost] = "1"
-		}
+	// the snippet of the old version is not referenced anymore
+	if key := g.snippetKey(ingressObj); key != "" && key != g.snippetKey(newIngressObj) {
+		errs = append(errs, g.Ep.RedisClient.DBOneDel(key))
 	}
+	return errors.Join(errs...)
+}
 
-	for _, ingressRule := range ingressObj.Spec.Rules {
-		host := ingressRule.Host
-		if host == "" {
-			host = "*"
-		}
-		scheme := "http"
-		if _, ok := tlsHosts[host]; ok {
-			scheme = "https"
-		}
+// Helper for Deletes
+func (g *IgHandler) delete(obj interface{}) error {
+	ingressObj, ok := obj.(*nv1.Ingress)
+	if !ok {
+		log.Println("In HandlerIngress Delete; cannot cast to *nv1.Ingress")
+		return nil
+	}
 
-		for _, httpPath := range ingressRule.HTTP.Paths {
+	if !g.includeIngress(ingressObj) {
+		log.Println("Namespace not included or Ingress Class not matched")
+		return nil
+	}
+	return g.uninstall(ingressObj)
+}
 
-			path := httpPath.Path
-			pathType := *httpPath.PathType
-			hostPath := util.ConstructHostPathString(scheme, host, path, pathType)
-			service := httpPath.Backend.Service.Name
-			port := strconv.Itoa(int(httpPath.Backend.Service.Port.Number))
-			svcport := util.ConstructSvcPortString(namespace, service, port)
+// install writes the snippet and the routes of an Ingress
+func (g *IgHandler) install(ingressObj *nv1.Ingress) error {
+	var errs []error
 
-			g.Ep.RedisClient.DBOneSAdd(hostPath, svcport)
+	g.reportAnnotations(nil, ingressObj)
 
-			if snippetErr == nil {
-				g.Ep.RedisClient.DBOneSAdd(hostPath, nameversion)
-			}
-		}
+	// add the script before adding route
+	snippet, ok, err := g.snippet(ingressObj)
+	if ok {
+		log.Println("Snippet in the handlerIngress.go file: ", snippet)
+		errs = append(errs, g.Ep.RedisClient.DBOneSAdd(nameVersion(ingressObj), snippet))
+	} else if err != nil {
+		g.rejectSnippet(ingressObj, err)
+	}
 
+	routes := g.routes(ingressObj, g.getBackend)
+	for _, r := range routes {
+		errs = append(errs, g.Ep.RedisClient.DBOneSAdd(r.hostPath, r.member))
 	}
+	g.flagConflicts(ingressObj, routes)
+	return errors.Join(errs...)
 }
 
-// Update for EventHandler
-func (g *IgHandler) Update(obj, newObj interface{}) {
-	log.Printf("In INGRESS_HANDLER UPDATE %#v \n", newObj)
-	g.update(obj, newObj)
-	g.Ep.RedisClient.PrintAllKeys()
+// uninstall removes the routes and the snippet of an Ingress
+func (g *IgHandler) uninstall(ingressObj *nv1.Ingress) error {
+	var errs []error
+	for _, r := range g.routes(ingressObj, g.getBackend) {
+		errs = append(errs, g.Ep.RedisClient.DBOneSRem(r.hostPath, r.member))
+	}
+	if key := g.snippetKey(ingressObj); key != "" {
+		errs = append(errs, g.Ep.RedisClient.DBOneDel(key))
+	}
+	return errors.Join(errs...)
 }
 
-func (g *IgHandler) update(obj, newObj interface{}) {
-	ingressObj, ok := obj.(*nv1.Ingress)
-	if !ok {
-		log.Println("In HandlerIngress Update; cannot cast to *nv1.Ingress")
-		return
+// resyncService re-syncs the routes of the Ingresses pointing at a Service
+// whose spec changed from oldSvc to newSvc. oldSvc is nil when the Service
+// is created and newSvc is nil when it is deleted.
+func (g *IgHandler) resyncService(oldSvc, newSvc *v1.Service) error {
+	svc := newSvc
+	if svc == nil {
+		svc = oldSvc
 	}
-
-	newIngressObj, ok := newObj.(*nv1.Ingress)
-	if !ok {
-		log.Println("In HandlerIngress Update; cannot cast to *nv1.Ingress")
-		return
+	if svc == nil {
+		return nil
 	}
+	name := svc.GetName()
+	return g.resyncBackend(svc.GetNamespace(), name,
+		func(namespace, n string) (*v1.Service, map[string]string) {
+			s, portNames := g.getBackend(namespace, n)
+			if n == name {
+				s = oldSvc
+			}
+			return s, portNames
+		},
+		func(namespace, n string) (*v1.Service, map[string]string) {
+			s, portNames := g.getBackend(namespace, n)
+			if n == name {
+				s = newSvc
+			}
+			return s, portNames
+		})
+}
 
-	m := make(map[string]string)
+// resyncPortNames re-syncs the routes of the Ingresses pointing at a Service
+// whose endpoint port names changed from oldNames to newNames
+func (g *IgHandler) resyncPortNames(namespace, name string, oldNames, newNames map[string]string) error {
+	return g.resyncBackend(namespace, name,
+		func(namespace, n string) (*v1.Service, map[string]string) {
+			s, portNames := g.getBackend(namespace, n)
+			if n == name {
+				portNames = oldNames
+			}
+			return s, portNames
+		},
+		func(namespace, n string) (*v1.Service, map[string]string) {
+			s, portNames := g.getBackend(namespace, n)
+			if n == name {
+				portNames = newNames
+			}
+			return s, portNames
+		})
+}
 
-	namespace := ingressObj.GetNamespace()
-	// v1.18 ingress class name field in ingress object
-	//ingressClass, _ := util.ExtractIngressClass(ingressObj.GetAnnotations())
-	ingressClass, _ := util.ExtractIngressClassName(obj)
-	if g.Ep.NsManager.IncludeNamespace(namespace) && g.Ep.ATSManager.IncludeIngressClass(ingressClass) {
-		log.Println("Old Namespace included")
+// resyncBackend moves the routes of the Ingresses pointing at a Service from
+// what oldLookup resolves them to, to what newLookup does
+func (g *IgHandler) resyncBackend(namespace, name string, oldLookup, newLookup backendLookup) error {
+	if g.IgLister == nil {
+		return nil
+	}
+
+	ingresses, err := g.IgLister.Ingresses(namespace).List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("listing ingresses in %s failed: %v", namespace, err)
+	}
 
-		name := ingressObj.GetName()
-		version := ingressObj.GetResourceVersion()
-		nameversion := util.ConstructNameVersionString(namespace, name, version)
+	var errs []error
+	for _, ingressObj := range ingresses {
+		if !referencesService(ingressObj, name) || !g.includeIngress(ingressObj) {
+			continue
+		}
+		log.Printf("Re-syncing ingress %s/%s for service %s", ingressObj.GetNamespace(), ingressObj.GetName(), name)
 
-		_, snippetErr := util.ExtractServerSnippet(ingressObj.GetAnnotations())
+		errs = append(errs, g.applyRoutes(g.routes(ingressObj, oldLookup), g.routes(ingressObj, newLookup)))
+	}
+	return errors.Join(errs...)
+}
 
-		// handle default backend rules
-		if ingressObj.Spec.DefaultBackend != nil {
-			host := "*"
-			scheme := "http"
-			path := "/"
-			pathType := nv1.PathTypePrefix
-			hostPath := util.ConstructHostPathString(scheme, host, path, pathType)
+// applyRoutes removes the routes only found in oldRoutes and adds the ones
+// only found in newRoutes
+func (g *IgHandler) applyRoutes(oldRoutes, newRoutes []hostPathRoute) error {
+	var errs []error
+	keep := make(map[hostPathRoute]bool, len(newRoutes))
+	for _, r := range newRoutes {
+		keep[r] = true
+	}
+	drop := make(map[hostPathRoute]bool, len(oldRoutes))
+	for _, r := range oldRoutes {
+		drop[r] = true
+		if !keep[r] {
+			errs = append(errs, g.Ep.RedisClient.DBOneSRem(r.hostPath, r.member))
+		}
+	}
+	for _, r := range newRoutes {
+		if !drop[r] {
+			errs = append(errs, g.Ep.RedisClient.DBOneSAdd(r.hostPath, r.member))
+		}
+	}
+	return errors.Join(errs...)
+}
 
-			g.Ep.RedisClient.DBOneSUnionStore("temp_"+hostPath, hostPath)
-			m["temp_"+hostPath] = hostPath
+// routes computes the host/path entries of an Ingress, resolving the ports
+// of its backends through the Services and Endpoints returned by lookup. The
+// backends of a canary Ingress are only added as canary options. The options
+// are qualified with the Ingress.
+func (g *IgHandler) routes(ingressObj *nv1.Ingress, lookup backendLookup) []hostPathRoute {
+	var routes []hostPathRoute
 
-			service := ingressObj.Spec.DefaultBackend.Service.Name
-			port := strconv.Itoa(int(ingressObj.Spec.DefaultBackend.Service.Port.Number))
-			svcport := util.ConstructSvcPortString(namespace, service, port)
+	namespace := ingressObj.GetNamespace()
+	nameversion := nameVersion(ingressObj)
+	_, hasSnippet, _ := g.snippet(ingressObj)
+	rewrite := g.rewrite(ingressObj)
+
+	canary, isCanary, err := util.ExtractCanary(ingressObj.GetAnnotations())
+	if err != nil {
+		// taken for a primary, the canary would get its share of all requests
+		return nil
+	}
 
-			g.Ep.RedisClient.DBOneSRem("temp_"+hostPath, svcport)
+	// invalid annotations are ignored, and reported by reportAnnotations
+	backendOptions, _ := util.ExtractLoadBalance(ingressObj.GetAnnotations())
+	// the protocol of an Ingress overrides the ones of its Services
+	protocol, _ := util.ExtractBackendProtocol(ingressObj.GetAnnotations())
+	if protocol != "" {
+		backendOptions = append(backendOptions, util.ConstructRouteOptionString(util.RouteOptionBackendProtocol, protocol))
+	}
+	backendOptions = append(backendOptions, g.proxySSL(ingressObj)...)
+	timeouts, _ := util.ExtractTimeoutsAndRetries(ingressObj.GetAnnotations())
+	backendOptions = append(backendOptions, timeouts...)
+	headers, _ := util.ExtractHeaders(ingressObj.GetAnnotations())
+	backendOptions = append(backendOptions, headers...)
+
+	addRoute := func(hostPath, path string, backend *nv1.IngressServiceBackend) {
+		svc, portNames := lookup(namespace, backend.Name)
+		port, ok := backendPort(backend, svc, portNames)
+		if !ok {
+			log.Printf("Port of backend service %s/%s cannot be resolved", namespace, backend.Name)
+			return
+		}
+		svcport := util.ConstructSvcPortString(namespace, backend.Name, port)
 
-			if snippetErr == nil {
-				g.Ep.RedisClient.DBOneSRem("temp_"+hostPath, nameversion)
+		if isCanary {
+			routes = append(routes, hostPathRoute{hostPath, util.ConstructRouteOptionString(util.RouteOptionCanaryBackend, svcport)})
+			for _, option := range canary {
+				routes = append(routes, hostPathRoute{hostPath, option})
 			}
+			return
+		}
 
-			// handle default backend https rule
-			scheme = "https"
-			hostPath = util.ConstructHostPathString(scheme, host, path, pathType)
+		routes = append(routes, hostPathRoute{hostPath, svcport})
+
+		if hasSnippet {
+			routes = append(routes, hostPathRoute{hostPath, nameversion})
+		}
+		for _, option := range rewrite(path) {
+			routes = append(routes, hostPathRoute{hostPath, option})
+		}
+		for _, option := range backendOptions {
+			routes = append(routes, hostPathRoute{hostPath, option})
+		}
+	}
 
-			g.Ep.RedisClient.DBOneSUnionStore("temp_"+hostPath, hostPath)
-			m["temp_"+hostPath] = hostPath
+	// default backend rules, for http and https
+	if ingressObj.Spec.DefaultBackend != nil && ingressObj.Spec.DefaultBackend.Service != nil {
+		for _, scheme := range []string{"http", "https"} {
+			hostPath := util.ConstructHostPathString(scheme, "*", "/", nv1.PathTypePrefix)
+			addRoute(hostPath, "/", ingressObj.Spec.DefaultBackend.Service)
+		}
+	}
 
-			g.Ep.RedisClient.DBOneSRem("temp_"+hostPath, svcport)
+	tlsHosts := make(map[string]string)
 
-			if snippetErr == nil {
-				g.Ep.RedisClient.DBOneSRem("temp_"+hostPath, nameversion)
-			}
+	for _, ingressTLS := range ingressObj.Spec.TLS {
+		for _, tlsHost := range ingressTLS.Hosts {
+			tlsHosts[tlsHost] = "1"
 		}
+	}
 
-		tlsHosts := make(map[string]string)
+	sslRedirect := g.sslRedirect(ingressObj)
 
-		for _, ingressTLS := range ingressObj.Spec.TLS {
-			for _, tlsHost := range ingressTLS.Hosts {
-				tlsHosts[tlsHost] = "1"
-			}
+	for _, ingressRule := range ingressObj.Spec.Rules {
+		if ingressRule.HTTP == nil {
+			continue
+		}
+		host := ingressRule.Host
+		if host == "" {
+			host = "*"
+		}
+		scheme := "http"
+		if _, ok := tlsHosts[host]; ok {
+			scheme = "https"
 		}
 
-		for _, ingressRule := range ingressObj.Spec.Rules {
-			host := ingressRule.Host
-			if host == "" {
-				host = "*"
+		for _, httpPath := range ingressRule.HTTP.Paths {
+			if httpPath.Backend.Service == nil {
+				continue
 			}
-			scheme := "http"
-			if _, ok := tlsHosts[host]; ok {
-				scheme = "https"
+			pathType := nv1.PathTypeImplementationSpecific
+			if httpPath.PathType != nil {
+				pathType = *httpPath.PathType
 			}
+			hostPath := util.ConstructHostPathString(scheme, host, httpPath.Path, pathType)
+			addRoute(hostPath, httpPath.Path, httpPath.Backend.Service)
 
-			for _, httpPath := range ingressRule.HTTP.Paths {
-
-				path := httpPath.Path
-				pathType := *httpPath.PathType
-				hostPath := util.ConstructHostPathString(scheme, host, path, pathType)
-
-				g.Ep.RedisClient.DBOneSUnionStore("temp_"+hostPath, hostPath)
-				m["temp_"+hostPath] = hostPath
+			if scheme == "https" && sslRedirect && !isCanary {
+				// the http variant only answers with a redirect
+				httpHostPath := util.ConstructHostPathString("http", host, httpPath.Path, pathType)
+				routes = append(routes, hostPathRoute{httpHostPath, util.ConstructRouteOptionString(util.RouteOptionSSLRedirect, "true")})
+			}
+		}
+	}
 
-				service := httpPath.Backend.Service.Name
-				port := strconv.Itoa(int(httpPath.Backend.Service.Port.Number))
-				svcport := util.ConstructSvcPortString(namespace, service, port)
+	// the options are owned by the Ingress, for those of other Ingresses on
+	// the same host/path to be kept apart
+	for i, r := range routes {
+		if strings.HasPrefix(r.member, "@") {
+			routes[i].member = util.ConstructOwnedRouteOptionString(namespace, ingressObj.GetName(), r.member)
+		}
+	}
+	return routes
+}
 
-				g.Ep.RedisClient.DBOneSRem("temp_"+hostPath, svcport)
+// sslRedirect tells if plain http requests for the TLS hosts of an Ingress
+// are redirected to https. The annotation overrides the global setting.
+func (g *IgHandler) sslRedirect(ingressObj *nv1.Ingress) bool {
+	redirect, ok, err := util.ExtractSSLRedirect(ingressObj.GetAnnotations())
+	if err != nil {
+		return g.SSLRedirect
+	}
+	if !ok {
+		return g.SSLRedirect
+	}
+	return redirect
+}
 
-				if snippetErr == nil {
-					g.Ep.RedisClient.DBOneSRem("temp_"+hostPath, nameversion)
-				}
+// rewrite returns the options rewriting the path of the requests forwarded
+// for a route path. rewrite-target takes precedence over strip-prefix.
+// Without rewrite-pattern, the captures of the target are taken from the
+// remainder of the request path after the route path.
+func (g *IgHandler) rewrite(ingressObj *nv1.Ingress) func(path string) []string {
+	ann := ingressObj.GetAnnotations()
+
+	pattern, target, ok, err := util.ExtractRewriteTarget(ann)
+	if ok && err == nil {
+		return func(path string) []string {
+			routePattern := pattern
+			if routePattern == "" {
+				routePattern = "^" + luaPatternEscape(strings.TrimSuffix(path, "/")) + "/?(.*)"
+			}
+			return []string{
+				util.ConstructRouteOptionString(util.RouteOptionRewritePattern, routePattern),
+				util.ConstructRouteOptionString(util.RouteOptionRewriteTarget, target),
 			}
-
 		}
 	}
 
-	newNamespace := newIngressObj.GetNamespace()
-	// v1.18 ingress class name field in ingress object
-	//newIngressClass, _ := util.ExtractIngressClass(newIngressObj.GetAnnotations())
-	newIngressClass, _ := util.ExtractIngressClassName(newObj)
-	if g.Ep.NsManager.IncludeNamespace(newNamespace) && g.Ep.ATSManager.IncludeIngressClass(newIngressClass) {
-		log.Println("New Namespace included")
-
-		name := newIngressObj.GetName()
-		version := newIngressObj.GetResourceVersion()
-		nameversion := util.ConstructNameVersionString(newNamespace, name, version)
+	strip, _, _ := util.ExtractStripPrefix(ann)
+	return func(path string) []string {
+		if !strip || path == "" || path == "/" {
+			return nil
+		}
+		return []string{util.ConstructRouteOptionString(util.RouteOptionStripPrefix, strings.TrimSuffix(path, "/"))}
+	}
+}
 
-		newSnippet, newSnippetErr := util.ExtractServerSnippet(newIngressObj.GetAnnotations())
-		if newSnippetErr == nil {
-			g.Ep.RedisClient.DBOneSAdd(nameversion, newSnippet)
+// luaPatternEscape escapes the magic characters of Lua patterns
+func luaPatternEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune("^$()%.[]*+-?", c) {
+			b.WriteRune('%')
 		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
 
-		// handle default backend rule
-		if newIngressObj.Spec.DefaultBackend != nil {
-			host := "*"
-			scheme := "http"
-			path := "/"
-			pathType := nv1.PathTypePrefix
-			hostPath := util.ConstructHostPathString(scheme, host, path, pathType)
+// proxySSL returns the options verifying the certificates of the https
+// backends of an Ingress, and presenting them a client certificate. The
+// files of the Secrets are written by the TLSManager.
+func (g *IgHandler) proxySSL(ingressObj *nv1.Ingress) []string {
+	caSecret, name, clientSecret, err := util.ExtractProxySSL(ingressObj.GetAnnotations())
+	if err != nil || g.CertDir == "" {
+		return nil
+	}
+	if caSecret == "" && name == "" && clientSecret == "" {
+		return nil
+	}
 
-			service := newIngressObj.Spec.DefaultBackend.Service.Name
-			port := strconv.Itoa(int(newIngressObj.Spec.DefaultBackend.Service.Port.Number))
-			svcport := util.ConstructSvcPortString(newNamespace, service, port)
+	var options []string
+	if caSecret != "" {
+		_, _, caFile := secretFiles(g.CertDir, ingressObj.GetNamespace(), caSecret)
+		options = append(options, util.ConstructRouteOptionString(util.RouteOptionProxySSLCA, caFile))
+	}
+	if name != "" {
+		options = append(options, util.ConstructRouteOptionString(util.RouteOptionProxySSLName, name))
+	}
+	if clientSecret != "" {
+		certFile, keyFile, _ := secretFiles(g.CertDir, ingressObj.GetNamespace(), clientSecret)
+		options = append(options,
+			util.ConstructRouteOptionString(util.RouteOptionProxySSLCert, certFile),
+			util.ConstructRouteOptionString(util.RouteOptionProxySSLKey, keyFile))
+	}
+	return options
+}
 
-			g.Ep.RedisClient.DBOneSAdd("temp_"+hostPath, svcport)
-			m["temp_"+hostPath] = hostPath
+// includeIngress tells if the namespace and class of an Ingress are watched
+func (g *IgHandler) includeIngress(ingressObj *nv1.Ingress) bool {
+	return g.Ep.NsManager.IncludeNamespace(ingressObj.GetNamespace()) && g.includeClass(ingressObj)
+}
 
-			if newSnippetErr == nil {
-				g.Ep.RedisClient.DBOneSAdd("temp_"+hostPath, nameversion)
-			}
+// includeClass tells if the IngressClass of an Ingress is served by this
+// controller. The class is taken from spec.ingressClassName, then from the
+// legacy annotation, and an Ingress with neither gets the default
+// IngressClass. Classes that have no IngressClass object, and Ingresses
+// without a class while there is no default one, fall back to the static
+// class.
+func (g *IgHandler) includeClass(ingressObj *nv1.Ingress) bool {
+	ingressClass, err := util.ExtractIngressClassName(ingressObj)
+	if err != nil {
+		ingressClass, err = util.ExtractIngressClass(ingressObj.GetAnnotations())
+		if err == nil && !g.ClassAnnotation {
+			return false
+		}
+	}
+	if g.ClassLister == nil {
+		return g.Ep.ATSManager.IncludeIngressClass(ingressClass)
+	}
 
-			// handle default backend rule for https as well
-			scheme = "https"
-			hostPath = util.ConstructHostPathString(scheme, host, path, pathType)
+	var class *nv1.IngressClass
+	if ingressClass != "" {
+		class, _ = g.ClassLister.Get(ingressClass)
+	} else {
+		class = g.defaultClass()
+	}
+	if class == nil {
+		// a class without object, e.g. one of another controller in its
+		// annotation, is only served when named by -atsIngressClass, as
+		// leaving that empty includes every class
+		if ingressClass != "" && g.Ep.ATSManager.IncludeIngressClass("") {
+			return false
+		}
+		return g.Ep.ATSManager.IncludeIngressClass(ingressClass)
+	}
+	return class.Spec.Controller == g.Controller && g.Ep.ATSManager.IncludeIngressClass(class.GetName())
+}
 
-			g.Ep.RedisClient.DBOneSAdd("temp_"+hostPath, svcport)
-			m["temp_"+hostPath] = hostPath
+// defaultClass returns the IngressClass annotated as the default one, nil if
+// none is. Should several be, the one of this controller wins, then the
+// oldest one.
+func (g *IgHandler) defaultClass() *nv1.IngressClass {
+	classes, err := g.ClassLister.List(labels.Everything())
+	if err != nil {
+		log.Printf("listing ingressclasses failed: %v", err)
+		return nil
+	}
 
-			if newSnippetErr == nil {
-				g.Ep.RedisClient.DBOneSAdd("temp_"+hostPath, nameversion)
+	var found *nv1.IngressClass
+	for _, class := range classes {
+		if class.GetAnnotations()[nv1.AnnotationIsDefaultIngressClass] != "true" {
+			continue
+		}
+		switch {
+		case found == nil:
+			found = class
+		case (class.Spec.Controller == g.Controller) != (found.Spec.Controller == g.Controller):
+			if class.Spec.Controller == g.Controller {
+				found = class
 			}
+		case class.CreationTimestamp.Before(&found.CreationTimestamp):
+			found = class
 		}
+	}
+	return found
+}
 
-		newTlsHosts := make(map[string]string)
+// serviceProtocol returns the backend protocol annotated on a Service, empty
+// when there is none. g can be nil, as the IgHandler of the handlers of
+// endpoints is optional.
+func (g *IgHandler) serviceProtocol(namespace, name string) string {
+	if g == nil || g.SvcLister == nil {
+		return ""
+	}
+	svc, err := g.SvcLister.Services(namespace).Get(name)
+	if err != nil {
+		return ""
+	}
+	protocol, _ := util.ExtractBackendProtocol(svc.GetAnnotations())
+	return protocol
+}
 
-		for _, newIngressTLS := range newIngressObj.Spec.TLS {
-			for _, newTlsHost := range newIngressTLS.Hosts {
-				newTlsHosts[newTlsHost] = "1"
-			}
+// getBackend looks the Service and its endpoint port names up in the listers
+func (g *IgHandler) getBackend(namespace, name string) (svc *v1.Service, portNames map[string]string) {
+	if g.SvcLister != nil {
+		if s, err := g.SvcLister.Services(namespace).Get(name); err == nil {
+			svc = s
 		}
+	}
+	switch {
+	case g.SliceLister != nil:
+		slices, err := g.SliceLister.EndpointSlices(namespace).List(serviceSelector(name))
+		if err == nil {
+			portNames = slicePortNames(slices)
+		}
+	case g.EpLister != nil:
+		if eps, err := g.EpLister.Endpoints(namespace).Get(name); err == nil {
+			portNames = endpointsPortNames(eps)
+		}
+	}
+	return svc, portNames
+}
 
-		for _, ingressRule := range newIngressObj.Spec.Rules {
-			host := ingressRule.Host
-			if host == "" {
-				host = "*"
-			}
-			scheme := "http"
-			if _, ok := newTlsHosts[host]; ok {
-				scheme = "https"
-			}
+// GetResourceName returns the resource name
+func (g *IgHandler) GetResourceName() string {
+	return g.ResourceName
+}
 
-			for _, httpPath := range ingressRule.HTTP.Paths {
+func nameVersion(ingressObj *nv1.Ingress) string {
+	return util.ConstructNameVersionString(ingressObj.GetNamespace(), ingressObj.GetName(), ingressObj.GetResourceVersion())
+}
 
-				path := httpPath.Path
-				pathType := *httpPath.PathType
-				hostPath := util.ConstructHostPathString(scheme, host, path, pathType)
+// snippetKey returns the key of the snippet of an Ingress version, which
+// the version owns, or "" if it has no snippet
+func (g *IgHandler) snippetKey(ingressObj *nv1.Ingress) string {
+	if _, ok, _ := g.snippet(ingressObj); !ok {
+		return ""
+	}
+	return nameVersion(ingressObj)
+}
 
-				service := httpPath.Backend.Service.Name
-				port := strconv.Itoa(int(httpPath.Backend.Service.Port.Number))
-				svcport := util.ConstructSvcPortString(newNamespace, service, port)
+// snippet returns the server-snippet of an Ingress. ok is false when it has
+// none or it is rejected, and err then tells why it is rejected.
+func (g *IgHandler) snippet(ingressObj *nv1.Ingress) (snippet string, ok bool, err error) {
+	snippet, err = util.ExtractServerSnippet(ingressObj.GetAnnotations())
+	if err != nil {
+		return "", false, nil
+	}
 
-				g.Ep.RedisClient.DBOneSAdd("temp_"+hostPath, svcport)
-				m["temp_"+hostPath] = hostPath
+	switch {
+	case !g.Snippets:
+		return "", false, errors.New("snippets are disabled")
+	case g.SnippetNamespaces != nil && !g.SnippetNamespaces[ingressObj.GetNamespace()]:
+		return "", false, fmt.Errorf("snippets are not allowed in namespace %s", ingressObj.GetNamespace())
+	}
+	if err := util.ValidateSnippet(snippet); err != nil {
+		return "", false, fmt.Errorf("invalid snippet: %v", err)
+	}
+	return snippet, true, nil
+}
 
-				if newSnippetErr == nil {
-					g.Ep.RedisClient.DBOneSAdd("temp_"+hostPath, nameversion)
-				}
+// flagConflicts logs the options of an Ingress that other Ingresses set to
+// other values on the same host/path, and records them as Events. The
+// router applies the ones of the Ingress whose namespace/name sorts first.
+func (g *IgHandler) flagConflicts(ingressObj *nv1.Ingress, routes []hostPathRoute) {
+	self := ingressObj.GetNamespace() + "/" + ingressObj.GetName()
+
+	options := make(map[string]map[string]string)
+	for _, r := range routes {
+		if _, option, value, ok := util.ParseOwnedRouteOptionString(r.member); ok {
+			if options[r.hostPath] == nil {
+				options[r.hostPath] = make(map[string]string)
 			}
-
+			options[r.hostPath][option] = value
 		}
 	}
 
-	for key, value := range m {
-		g.Ep.RedisClient.DBOneSUnionStore(value, key)
-		g.Ep.RedisClient.DBOneDel(key)
+	for hostPath, own := range options {
+		members, err := g.Ep.RedisClient.DBOneSMembers(hostPath)
+		if err != nil {
+			continue
+		}
+		for _, member := range members {
+			owner, option, value, ok := util.ParseOwnedRouteOptionString(member)
+			if !ok || owner == self {
+				continue
+			}
+			if ownValue, set := own[option]; set && ownValue != value {
+				applied := self
+				if owner < self {
+					applied = owner
+				}
+				log.Printf("Ingress %s: option %s of %s conflicts with Ingress %s", self, option, hostPath, owner)
+				if g.Recorder != nil {
+					g.Recorder.Eventf(ingressObj, v1.EventTypeWarning, "RouteConflict",
+						"Option %s of %s conflicts with Ingress %s, the one of %s applies", option, hostPath, owner, applied)
+				}
+			}
+		}
 	}
 }
 
-// Delete for EventHandler
-func (g *IgHandler) Delete(obj interface{}) {
-	log.Printf("In INGRESS_HANDLER DELETE %#v \n", obj)
-	g.delete(obj)
-	g.Ep.RedisClient.PrintAllKeys()
-}
-
-// Helper for Deletes
-func (g *IgHandler) delete(obj interface{}) {
-	ingressObj, ok := obj.(*nv1.Ingress)
-	if !ok {
-		log.Println("In HandlerIngress Delete; cannot cast to *nv1.Ingress")
-		return
+// annotationErrors returns why annotations of an Ingress are invalid, which
+// routes ignores
+func (g *IgHandler) annotationErrors(ingressObj *nv1.Ingress) []error {
+	ann := ingressObj.GetAnnotations()
+	var errs []error
+	collect := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	namespace := ingressObj.GetNamespace()
-	// v1.18 ingress class name field in ingress object
-	//ingressClass, _ := util.ExtractIngressClass(ingressObj.GetAnnotations())
-	ingressClass, _ := util.ExtractIngressClassName(obj)
-	if !g.Ep.NsManager.IncludeNamespace(namespace) || !g.Ep.ATSManager.IncludeIngressClass(ingressClass) {
-		log.Println("Namespace not included or Ingress Class not matched")
-		return
+	_, _, err := util.ExtractCanary(ann)
+	collect(err)
+	_, err = util.ExtractLoadBalance(ann)
+	collect(err)
+	_, err = util.ExtractBackendProtocol(ann)
+	collect(err)
+	_, err = util.ExtractTimeoutsAndRetries(ann)
+	collect(err)
+	_, err = util.ExtractHeaders(ann)
+	collect(err)
+	_, _, err = util.ExtractSSLRedirect(ann)
+	collect(err)
+	_, _, _, err = util.ExtractRewriteTarget(ann)
+	collect(err)
+	_, _, err = util.ExtractStripPrefix(ann)
+	collect(err)
+
+	caSecret, name, clientSecret, err := util.ExtractProxySSL(ann)
+	collect(err)
+	if err == nil && g.CertDir == "" && (caSecret != "" || name != "" || clientSecret != "") {
+		errs = append(errs, errors.New("proxy-ssl annotations need certificates to be managed"))
 	}
+	return errs
+}
 
-	name := ingressObj.GetName()
-	version := ingressObj.GetResourceVersion()
-	nameversion := util.ConstructNameVersionString(namespace, name, version)
-
-	_, snippetErr := util.ExtractServerSnippet(ingressObj.GetAnnotations())
-
-	if ingressObj.Spec.DefaultBackend != nil {
-		host := "*"
-		scheme := "http"
-		path := "/"
-		pathType := nv1.PathTypePrefix
-		hostPath := util.ConstructHostPathString(scheme, host, path, pathType)
-		service := ingressObj.Spec.DefaultBackend.Service.Name
-		port := strconv.Itoa(int(ingressObj.Spec.DefaultBackend.Service.Port.Number))
-		svcport := util.ConstructSvcPortString(namespace, service, port)
-
-		g.Ep.RedisClient.DBOneSRem(hostPath, svcport)
-
-		if snippetErr == nil {
-			g.Ep.RedisClient.DBOneSRem(hostPath, nameversion)
+// reportAnnotations reports the invalid annotations of an Ingress, except
+// those already invalid in its previous version prev, which can be nil
+func (g *IgHandler) reportAnnotations(prev, ingressObj *nv1.Ingress) {
+	reported := make(map[string]bool)
+	if prev != nil {
+		for _, err := range g.annotationErrors(prev) {
+			reported[err.Error()] = true
 		}
-
-		scheme = "https"
-		hostPath = util.ConstructHostPathString(scheme, host, path, pathType)
-
-		g.Ep.RedisClient.DBOneSRem(hostPath, svcport)
-
-		if snippetErr == nil {
-			g.Ep.RedisClient.DBOneSRem(hostPath, nameversion)
+	}
+	for _, err := range g.annotationErrors(ingressObj) {
+		if !reported[err.Error()] {
+			g.invalidAnnotation("Ingress", ingressObj, err)
 		}
 	}
+}
 
-	tlsHosts := make(map[string]string)
+// annotatedObject is an Ingress or a Service whose annotations are read
+type annotatedObject interface {
+	runtime.Object
+	GetNamespace() string
+	GetName() string
+}
 
-	for _, ingressTLS := range ingressObj.Spec.TLS {
-		for _, tlsHost := range ingressTLS.Hosts {
-			tlsHosts[tlsHost] = "1"
-		}
+// invalidAnnotation logs an invalid annotation of an object, which is
+// ignored, and records it as an Event
+func (g *IgHandler) invalidAnnotation(kind string, obj annotatedObject, err error) {
+	log.Printf("%s %s/%s: %v", kind, obj.GetNamespace(), obj.GetName(), err)
+	if g.Recorder != nil {
+		g.Recorder.Eventf(obj, v1.EventTypeWarning, "InvalidAnnotation", "Invalid annotation: %v", err)
 	}
+}
+
+// rejectSnippet logs why the snippet of an Ingress is rejected, and records
+// it as an Event
+func (g *IgHandler) rejectSnippet(ingressObj *nv1.Ingress, err error) {
+	log.Printf("Ingress %s/%s: %v", ingressObj.GetNamespace(), ingressObj.GetName(), err)
+	if g.Recorder != nil {
+		g.Recorder.Eventf(ingressObj, v1.EventTypeWarning, "SnippetRejected", "Snippet rejected: %v", err)
+	}
+}
 
+// referencesService tells if any backend of an Ingress is the named Service
+func referencesService(ingressObj *nv1.Ingress, name string) bool {
+	if backend := ingressObj.Spec.DefaultBackend; backend != nil && backend.Service != nil && backend.Service.Name == name {
+		return true
+	}
 	for _, ingressRule := range ingressObj.Spec.Rules {
-		host := ingressRule.Host
-		if host == "" {
-			host = "*"
+		if ingressRule.HTTP == nil {
+			continue
 		}
-		scheme := "http"
-		if _, ok := tlsHosts[host]; ok {
-			scheme = "https"
+		for _, httpPath := range ingressRule.HTTP.Paths {
+			if httpPath.Backend.Service != nil && httpPath.Backend.Service.Name == name {
+				return true
+			}
 		}
+	}
+	return false
+}
 
-		for _, httpPath := range ingressRule.HTTP.Paths {
+// backendPort resolves the port of an Ingress backend to the port its
+// Endpoints are keyed by in DB 0, i.e. the targetPort of the matching
+// Service port. Named targetPorts, and named backend ports of unknown
+// Services, are resolved through the Endpoints, whose ports carry the names
+// of the Service ports. Otherwise the backend port number is used as is.
+// ok is false when the port cannot be resolved at all.
+func backendPort(backend *nv1.IngressServiceBackend, svc *v1.Service, portNames map[string]string) (port string, ok bool) {
+	// Endpoints ports are named after the Service ports, which may be
+	// unnamed when there is only one
+	portName, named := backend.Port.Name, backend.Port.Name != ""
+
+	if svc != nil {
+		for _, svcPort := range svc.Spec.Ports {
+			if backend.Port.Name != "" && svcPort.Name != backend.Port.Name {
+				continue
+			}
+			if backend.Port.Name == "" && svcPort.Port != backend.Port.Number {
+				continue
+			}
+			switch {
+			case svcPort.TargetPort.Type == intstr.Int && svcPort.TargetPort.IntVal != 0:
+				return strconv.Itoa(int(svcPort.TargetPort.IntVal)), true
+			case svcPort.TargetPort.Type == intstr.Int:
+				// targetPort defaults to port
+				return strconv.Itoa(int(svcPort.Port)), true
+			}
+			// named targetPorts are resolved by the pods
+			portName, named = svcPort.Name, true
+			break
+		}
+	}
 
-			path := httpPath.Path
-			pathType := *httpPath.PathType
-			hostPath := util.ConstructHostPathString(scheme, host, path, pathType)
-			service := httpPath.Backend.Service.Name
-			port := strconv.Itoa(int(httpPath.Backend.Service.Port.Number))
-			svcport := util.ConstructSvcPortString(namespace, service, port)
+	if named {
+		if port, ok := portNames[portName]; ok {
+			return port, true
+		}
+	}
 
-			g.Ep.RedisClient.DBOneSRem(hostPath, svcport)
+	if backend.Port.Number == 0 {
+		return "", false
+	}
+	return strconv.Itoa(int(backend.Port.Number)), true
+}
 
-			if snippetErr == nil {
-				g.Ep.RedisClient.DBOneSRem(hostPath, nameversion)
+// endpointsPortNames maps the port names of Endpoints to their numbers.
+// Should pods disagree on a number, the lowest one is used.
+func endpointsPortNames(eps *v1.Endpoints) map[string]string {
+	nums := make(map[string]int32)
+	if eps != nil {
+		for _, subset := range eps.Subsets {
+			for _, port := range subset.Ports {
+				if num, ok := nums[port.Name]; !ok || port.Port < num {
+					nums[port.Name] = port.Port
+				}
 			}
 		}
-
 	}
+	return portNumbers(nums)
 }
 
-// GetResourceName returns the resource name
-func (g *IgHandler) GetResourceName() string {
-	return g.ResourceName
+func portNumbers(nums map[string]int32) map[string]string {
+	names := make(map[string]string, len(nums))
+	for name, num := range nums {
+		names[name] = strconv.Itoa(int(num))
+	}
+	return names
 }
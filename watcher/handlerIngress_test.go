@@ -15,6 +15,8 @@ package watcher
 
 import (
 	"log"
+	"reflect"
+	"strings"
 	"testing"
 
 	ep "github.com/apache/trafficserver-ingress-controller/endpoint"
@@ -25,6 +27,10 @@ import (
 
 	nv1 "k8s.io/api/networking/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	netlisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 var pathExact nv1.PathType = nv1.PathTypeExact
@@ -176,38 +182,979 @@ func TestUpdate_ModifySnippet(t *testing.T) {
 	}
 }
 
+func TestUpdate_RemoveSnippet(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngressWithAnnotation()
+	updatedExampleIngress := createExampleIngressWithAnnotation()
+
+	delete(updatedExampleIngress.ObjectMeta.Annotations, "ats.ingress.kubernetes.io/server-snippet")
+	updatedExampleIngress.SetResourceVersion("10")
+
+	igHandler.add(&exampleIngress)
+	igHandler.update(&exampleIngress, &updatedExampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+	expectedKeys := getExpectedKeysForAddWithAnnotation()
+	expectedKeys["E+http://test.edge.com/app1"] = []string{"trafficserver-test:appsvc1:8080"}
+	delete(expectedKeys, "$trafficserver-test/example-ingress/")
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_RejectedSnippet(t *testing.T) {
+	for _, test := range []struct {
+		snippets   bool
+		namespaces map[string]bool
+		snippet    string
+		expected   string
+	}{
+		{false, nil, getExampleSnippet(), "Warning SnippetRejected Snippet rejected: snippets are disabled"},
+		{true, map[string]bool{"trusted": true}, getExampleSnippet(), "Warning SnippetRejected Snippet rejected: snippets are not allowed in namespace trafficserver-test"},
+		{true, nil, "ts.debug('unterminated)", "Warning SnippetRejected Snippet rejected: invalid snippet: "},
+	} {
+		igHandler := createExampleIgHandler()
+		igHandler.Snippets = test.snippets
+		igHandler.SnippetNamespaces = test.namespaces
+		recorder := record.NewFakeRecorder(10)
+		igHandler.Recorder = recorder
+		exampleIngress := createExampleIngressWithAnnotation()
+		exampleIngress.Annotations[util.AnnotationServerSnippet] = test.snippet
+
+		igHandler.add(&exampleIngress)
+
+		returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+		expectedKeys := getExpectedKeysForAdd()
+		delete(expectedKeys, "E+http://test.media.com/app1")
+		delete(expectedKeys, "E+http://test.media.com/app2")
+
+		if !util.IsSameMap(returnedKeys, expectedKeys) {
+			t.Errorf("%q: returned \n%v,  but expected \n%v", test.expected, returnedKeys, expectedKeys)
+		}
+		if returned := <-recorder.Events; !strings.HasPrefix(returned, test.expected) {
+			t.Errorf("returned \n%v,  but expected \n%v", returned, test.expected)
+		}
+	}
+}
+
+func TestUpdate_SnippetNamespaces(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	igHandler.SnippetNamespaces = map[string]bool{"trafficserver-test": true}
+	exampleIngress := createExampleIngressWithAnnotation()
+	updatedExampleIngress := createExampleIngressWithAnnotation()
+	updatedExampleIngress.SetResourceVersion("10")
+
+	igHandler.add(&exampleIngress)
+	igHandler.update(&exampleIngress, &updatedExampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+	expectedKeys := getExpectedKeysForAddWithAnnotation()
+	expectedKeys["E+http://test.edge.com/app1"] = []string{"trafficserver-test:appsvc1:8080", "$trafficserver-test/example-ingress/10"}
+	expectedKeys["$trafficserver-test/example-ingress/10"] = expectedKeys["$trafficserver-test/example-ingress/"]
+	delete(expectedKeys, "$trafficserver-test/example-ingress/")
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
 func TestUpdate_ModifyTLS(t *testing.T) {
 	igHandler := createExampleIgHandler()
 	exampleIngress := createExampleIngress()
-	updatedExampleIngress := createExampleIngressWithTLS()
+	updatedExampleIngress := createExampleIngressWithTLS()
+
+	igHandler.add(&exampleIngress)
+	igHandler.update(&exampleIngress, &updatedExampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+https://test.edge.com/app1"] = expectedKeys["E+http://test.edge.com/app1"]
+	delete(expectedKeys, "E+http://test.edge.com/app1")
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestUpdate_StartOwning(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	igHandler.Ep.ATSManager = &proxy.ATSManager{Namespace: "default", IngressClass: "ats"}
+	exampleIngress := createExampleIngressWithAnnotation()
+	updatedExampleIngress := createExampleIngressWithAnnotation()
+
+	className, newClassName := "nginx", "ats"
+	exampleIngress.Spec.IngressClassName = &className
+	updatedExampleIngress.Spec.IngressClassName = &newClassName
+
+	igHandler.add(&exampleIngress)
+	igHandler.update(&exampleIngress, &updatedExampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+	expectedKeys := getExpectedKeysForAddWithAnnotation()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestUpdate_StopOwning(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	igHandler.Ep.ATSManager = &proxy.ATSManager{Namespace: "default", IngressClass: "ats"}
+	exampleIngress := createExampleIngressWithAnnotation()
+	updatedExampleIngress := createExampleIngressWithAnnotation()
+
+	className, newClassName := "ats", "nginx"
+	exampleIngress.Spec.IngressClassName = &className
+	updatedExampleIngress.Spec.IngressClassName = &newClassName
+
+	igHandler.add(&exampleIngress)
+	igHandler.update(&exampleIngress, &updatedExampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+	expectedKeys := make(map[string][]string)
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestUpdate_NeverOwned(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	igHandler.Ep.ATSManager = &proxy.ATSManager{Namespace: "default", IngressClass: "ats"}
+	exampleIngress := createExampleIngress()
+	updatedExampleIngress := createExampleIngress()
+
+	className := "nginx"
+	exampleIngress.Spec.IngressClassName = &className
+	updatedExampleIngress.Spec.IngressClassName = &className
+	updatedExampleIngress.Spec.Rules[0].IngressRuleValue.HTTP.Paths[1].Path = "/app2-modified"
+
+	igHandler.add(&exampleIngress)
+	igHandler.update(&exampleIngress, &updatedExampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+	expectedKeys := make(map[string][]string)
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestUpdate_StillOwnedSharedRoute(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+	updatedExampleIngress := createExampleIngress()
+
+	// the unchanged routes must survive the update
+	updatedExampleIngress.Spec.Rules[0].IngressRuleValue.HTTP.Paths[1].Path = "/app2-modified"
+
+	igHandler.add(&exampleIngress)
+	igHandler.update(&exampleIngress, &updatedExampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+http://test.media.com/app2-modified"] = expectedKeys["E+http://test.media.com/app2"]
+	delete(expectedKeys, "E+http://test.media.com/app2")
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	igHandler.delete(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := make(map[string][]string)
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+
+}
+
+func TestDelete_Snippet(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngressWithAnnotation()
+
+	igHandler.add(&exampleIngress)
+	igHandler.delete(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := make(map[string][]string)
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_ResolveServiceTargetPort(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	svc := createExampleService("appsvc1", 8080, intstr.FromInt(9080))
+	igHandler.SvcLister, _ = createExampleServiceLister(&svc)
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+http://test.edge.com/app1"] = []string{"trafficserver-test:appsvc1:9080"}
+	expectedKeys["E+http://test.media.com/app1"] = []string{"trafficserver-test:appsvc1:9080"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_ResolveNamedServicePort(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	exampleIngress.Spec.Rules[0].IngressRuleValue.HTTP.Paths[1].Backend.Service.Port = nv1.ServiceBackendPort{Name: "main"}
+
+	svc := createExampleService("appsvc2", 80, intstr.FromInt(9080))
+	igHandler.SvcLister, _ = createExampleServiceLister(&svc)
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+http://test.media.com/app2"] = []string{"trafficserver-test:appsvc2:9080"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_ResolveNamedTargetPort(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	exampleIngress.Spec.Rules[0].IngressRuleValue.HTTP.Paths[1].Backend.Service.Port = nv1.ServiceBackendPort{Name: "main"}
+
+	svc := createExampleService("appsvc2", 80, intstr.FromString("web"))
+	igHandler.SvcLister, _ = createExampleServiceLister(&svc)
+	eps := createExampleBackendEndpoints("appsvc2", "main", 9443)
+	igHandler.EpLister, _ = createExampleEndpointsLister(&eps)
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+http://test.media.com/app2"] = []string{"trafficserver-test:appsvc2:9443"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_ResolveNamedPortWithoutService(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	exampleIngress.Spec.Rules[0].IngressRuleValue.HTTP.Paths[1].Backend.Service.Port = nv1.ServiceBackendPort{Name: "main"}
+
+	eps := createExampleBackendEndpoints("appsvc2", "main", 9443)
+	igHandler.EpLister, _ = createExampleEndpointsLister(&eps)
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+http://test.media.com/app2"] = []string{"trafficserver-test:appsvc2:9443"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_UnresolvedNamedPort(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	exampleIngress.Spec.Rules[0].IngressRuleValue.HTTP.Paths[1].Backend.Service.Port = nv1.ServiceBackendPort{Name: "main"}
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	delete(expectedKeys, "E+http://test.media.com/app2")
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_IngressClassOfController(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	className := "ats"
+	exampleIngress.Spec.IngressClassName = &className
+	class := createExampleIngressClass("ats", "trafficserver.apache.org/ingress-controller", false)
+	igHandler.ClassLister = createExampleIngressClassLister(&class)
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_IngressClassOfOtherController(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	className := "nginx"
+	exampleIngress.Spec.IngressClassName = &className
+	class := createExampleIngressClass("nginx", "k8s.io/ingress-nginx", false)
+	igHandler.ClassLister = createExampleIngressClassLister(&class)
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := make(map[string][]string)
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_DefaultIngressClass(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	// a class of the controller, albeit named differently than the static one
+	igHandler.Ep.ATSManager = &proxy.ATSManager{Namespace: "default", IngressClass: "ats"}
+	class := createExampleIngressClass("ats", "trafficserver.apache.org/ingress-controller", true)
+	igHandler.ClassLister = createExampleIngressClassLister(&class)
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_DefaultIngressClassOfOtherController(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	defaultClass := createExampleIngressClass("nginx", "k8s.io/ingress-nginx", true)
+	class := createExampleIngressClass("ats", "trafficserver.apache.org/ingress-controller", false)
+	igHandler.ClassLister = createExampleIngressClassLister(&defaultClass, &class)
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := make(map[string][]string)
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_IngressClassWithoutObject(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	className := "ats"
+	exampleIngress.Spec.IngressClassName = &className
+	igHandler.Ep.ATSManager = &proxy.ATSManager{Namespace: "default", IngressClass: "ats"}
+	igHandler.ClassLister = createExampleIngressClassLister()
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_UnknownIngressClassAnnotation(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	exampleIngress.Annotations = map[string]string{util.AnnotationIngressClass: "nginx"}
+	igHandler.ClassAnnotation = true
+	igHandler.ClassLister = createExampleIngressClassLister()
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := make(map[string][]string)
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_IngressClassAnnotation(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	exampleIngress.Annotations = map[string]string{util.AnnotationIngressClass: "ats"}
+	igHandler.Ep.ATSManager = &proxy.ATSManager{Namespace: "default", IngressClass: "ats"}
+	igHandler.ClassAnnotation = true
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_IngressClassAnnotationNotAccepted(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	exampleIngress.Annotations = map[string]string{util.AnnotationIngressClass: "ats"}
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := make(map[string][]string)
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_IngressClassNameOverAnnotation(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	className := "nginx"
+	exampleIngress.Spec.IngressClassName = &className
+	exampleIngress.Annotations = map[string]string{util.AnnotationIngressClass: "ats"}
+	igHandler.ClassAnnotation = true
+	class := createExampleIngressClass("nginx", "k8s.io/ingress-nginx", false)
+	atsClass := createExampleIngressClass("ats", "trafficserver.apache.org/ingress-controller", false)
+	igHandler.ClassLister = createExampleIngressClassLister(&class, &atsClass)
 
 	igHandler.add(&exampleIngress)
-	igHandler.update(&exampleIngress, &updatedExampleIngress)
 
 	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := make(map[string][]string)
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_SSLRedirect(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngressWithTLS()
+
+	igHandler.SSLRedirect = true
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
 	expectedKeys := getExpectedKeysForAdd()
 	expectedKeys["E+https://test.edge.com/app1"] = expectedKeys["E+http://test.edge.com/app1"]
-	expectedKeys["E+http://test.edge.com/app1"] = []string{}
+	expectedKeys["E+http://test.edge.com/app1"] = []string{"@trafficserver-test/example-ingress/ssl-redirect=true"}
 
 	if !util.IsSameMap(returnedKeys, expectedKeys) {
 		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
 	}
 }
 
-func TestDelete(t *testing.T) {
+func TestAdd_SSLRedirectAnnotation(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngressWithTLS()
+
+	exampleIngress.Annotations = map[string]string{util.AnnotationSSLRedirect: "true"}
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+https://test.edge.com/app1"] = expectedKeys["E+http://test.edge.com/app1"]
+	expectedKeys["E+http://test.edge.com/app1"] = []string{"@trafficserver-test/example-ingress/ssl-redirect=true"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_SSLRedirectDisabledByAnnotation(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngressWithTLS()
+
+	exampleIngress.Annotations = map[string]string{util.AnnotationSSLRedirect: "false"}
+	igHandler.SSLRedirect = true
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+https://test.edge.com/app1"] = expectedKeys["E+http://test.edge.com/app1"]
+	delete(expectedKeys, "E+http://test.edge.com/app1")
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_RewriteTarget(t *testing.T) {
 	igHandler := createExampleIgHandler()
 	exampleIngress := createExampleIngress()
 
-	igHandler.delete(&exampleIngress)
+	exampleIngress.Annotations = map[string]string{util.AnnotationRewriteTarget: "/$1"}
+
+	igHandler.add(&exampleIngress)
 
 	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
 
-	expectedKeys := make(map[string][]string)
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+http://test.edge.com/app1"] = append(expectedKeys["E+http://test.edge.com/app1"], "@trafficserver-test/example-ingress/rewrite-pattern=^/app1/?(.*)", "@trafficserver-test/example-ingress/rewrite-target=/$1")
+	expectedKeys["E+http://test.media.com/app1"] = append(expectedKeys["E+http://test.media.com/app1"], "@trafficserver-test/example-ingress/rewrite-pattern=^/app1/?(.*)", "@trafficserver-test/example-ingress/rewrite-target=/$1")
+	expectedKeys["E+http://test.media.com/app2"] = append(expectedKeys["E+http://test.media.com/app2"], "@trafficserver-test/example-ingress/rewrite-pattern=^/app2/?(.*)", "@trafficserver-test/example-ingress/rewrite-target=/$1")
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_RewriteTargetWithPattern(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	exampleIngress.Annotations = map[string]string{
+		util.AnnotationRewriteTarget:  "/v2/$2",
+		util.AnnotationRewritePattern: "^/(app%d)/?(.*)",
+	}
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	for hostPath := range expectedKeys {
+		expectedKeys[hostPath] = append(expectedKeys[hostPath], "@trafficserver-test/example-ingress/rewrite-pattern=^/(app%d)/?(.*)", "@trafficserver-test/example-ingress/rewrite-target=/v2/$2")
+	}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_InvalidRewritePattern(t *testing.T) {
+	// regular expressions that Lua would match differently are rejected
+	for _, pattern := range []string{"^/(app1", "^/app1(/|$)(.*)", "^/app\\d/(.*)", "^/(?:app1)/(.*)", "^/app1/(.*?)$"} {
+		igHandler := createExampleIgHandler()
+		exampleIngress := createExampleIngress()
+
+		exampleIngress.Annotations = map[string]string{
+			util.AnnotationRewriteTarget:  "/$1",
+			util.AnnotationRewritePattern: pattern,
+		}
+
+		igHandler.add(&exampleIngress)
+
+		returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+		expectedKeys := getExpectedKeysForAdd()
+
+		if !util.IsSameMap(returnedKeys, expectedKeys) {
+			t.Errorf("%q: returned \n%v,  but expected \n%v", pattern, returnedKeys, expectedKeys)
+		}
+	}
+}
+
+func TestAdd_StripPrefix(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	exampleIngress.Annotations = map[string]string{util.AnnotationStripPrefix: "true"}
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+http://test.edge.com/app1"] = append(expectedKeys["E+http://test.edge.com/app1"], "@trafficserver-test/example-ingress/strip-prefix=/app1")
+	expectedKeys["E+http://test.media.com/app1"] = append(expectedKeys["E+http://test.media.com/app1"], "@trafficserver-test/example-ingress/strip-prefix=/app1")
+	expectedKeys["E+http://test.media.com/app2"] = append(expectedKeys["E+http://test.media.com/app2"], "@trafficserver-test/example-ingress/strip-prefix=/app2")
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_Canary(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+	canaryIngress := createExampleIngress()
+
+	canaryIngress.Name = "example-ingress-canary"
+	canaryIngress.Annotations = map[string]string{
+		util.AnnotationCanary:         "true",
+		util.AnnotationCanaryWeight:   "20",
+		util.AnnotationCanaryByHeader: "X-Canary",
+		util.AnnotationCanaryByCookie: "canary",
+	}
+
+	igHandler.add(&exampleIngress)
+	igHandler.add(&canaryIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	for hostPath, svcs := range expectedKeys {
+		expectedKeys[hostPath] = append(svcs, "@trafficserver-test/example-ingress-canary/canary-backend="+svcs[0], "@trafficserver-test/example-ingress-canary/canary-weight=20", "@trafficserver-test/example-ingress-canary/canary-by-header=X-Canary", "@trafficserver-test/example-ingress-canary/canary-by-cookie=canary")
+	}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_InvalidCanary(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+	canaryIngress := createExampleIngress()
+
+	canaryIngress.Name = "example-ingress-canary"
+	canaryIngress.Annotations = map[string]string{
+		util.AnnotationCanary:       "true",
+		util.AnnotationCanaryWeight: "120",
+	}
+
+	igHandler.add(&exampleIngress)
+	igHandler.add(&canaryIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_LoadBalance(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	exampleIngress.Annotations = map[string]string{
+		util.AnnotationLoadBalance:    "consistent-hash",
+		util.AnnotationUpstreamHashBy: "cookie:session",
+	}
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	for hostPath := range expectedKeys {
+		expectedKeys[hostPath] = append(expectedKeys[hostPath], "@trafficserver-test/example-ingress/load-balance=consistent-hash", "@trafficserver-test/example-ingress/upstream-hash-by=cookie:session")
+	}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestUpdate_ConflictingRouteOptions(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	recorder := record.NewFakeRecorder(10)
+	igHandler.Recorder = recorder
+	exampleIngress := createExampleIngress()
+	otherIngress := createExampleIngress()
+
+	exampleIngress.Annotations = map[string]string{
+		util.AnnotationLoadBalance: "round-robin",
+		util.AnnotationRetries:     "2",
+	}
+	otherIngress.Name = "other-ingress"
+	otherIngress.Annotations = map[string]string{
+		util.AnnotationLoadBalance: "least-requests",
+		util.AnnotationRetries:     "2",
+	}
+
+	igHandler.add(&exampleIngress)
+	igHandler.add(&otherIngress)
+
+	returnedEvents := make(map[string]bool)
+	for len(recorder.Events) > 0 {
+		returnedEvents[<-recorder.Events] = true
+	}
+
+	expectedKeys := getExpectedKeysForAdd()
+	expectedEvents := make(map[string]bool)
+	for hostPath := range expectedKeys {
+		expectedEvents["Warning RouteConflict Option load-balance of "+hostPath+
+			" conflicts with Ingress trafficserver-test/example-ingress, the one of trafficserver-test/example-ingress applies"] = true
+	}
+
+	if !reflect.DeepEqual(returnedEvents, expectedEvents) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedEvents, expectedEvents)
+	}
+
+	// the options of the other Ingress are removed without the ones it shares
+	newOtherIngress := otherIngress.DeepCopy()
+	newOtherIngress.Annotations = nil
+
+	igHandler.update(&otherIngress, newOtherIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	for hostPath := range expectedKeys {
+		expectedKeys[hostPath] = append(expectedKeys[hostPath], "@trafficserver-test/example-ingress/load-balance=round-robin",
+			"@trafficserver-test/example-ingress/retries=2", "@trafficserver-test/example-ingress/retry-on=connect-failure")
+	}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_InvalidLoadBalance(t *testing.T) {
+	for _, ann := range []map[string]string{
+		{util.AnnotationLoadBalance: "ewma"},
+		{util.AnnotationLoadBalance: "consistent-hash"},
+		{util.AnnotationLoadBalance: "consistent-hash", util.AnnotationUpstreamHashBy: "header:"},
+		{util.AnnotationLoadBalance: "random"},
+	} {
+		igHandler := createExampleIgHandler()
+		exampleIngress := createExampleIngress()
+
+		exampleIngress.Annotations = ann
+
+		igHandler.add(&exampleIngress)
+
+		returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+		expectedKeys := getExpectedKeysForAdd()
+
+		if !util.IsSameMap(returnedKeys, expectedKeys) {
+			t.Errorf("%v: returned \n%v,  but expected \n%v", ann, returnedKeys, expectedKeys)
+		}
+	}
+}
+
+func TestAdd_BackendProtocol(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	exampleIngress.Annotations = map[string]string{util.AnnotationBackendProtocol: "GRPCS"}
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	for hostPath := range expectedKeys {
+		expectedKeys[hostPath] = append(expectedKeys[hostPath], "@trafficserver-test/example-ingress/backend-protocol=grpcs")
+	}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestAdd_InvalidBackendProtocol(t *testing.T) {
+	for _, protocol := range []string{"SPDY", "HTTP/3"} {
+		igHandler := createExampleIgHandler()
+		recorder := record.NewFakeRecorder(10)
+		igHandler.Recorder = recorder
+		exampleIngress := createExampleIngress()
+
+		exampleIngress.Annotations = map[string]string{util.AnnotationBackendProtocol: protocol}
+
+		igHandler.add(&exampleIngress)
+
+		returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+		expectedKeys := getExpectedKeysForAdd()
+
+		if !util.IsSameMap(returnedKeys, expectedKeys) {
+			t.Errorf("%s: returned \n%v,  but expected \n%v", protocol, returnedKeys, expectedKeys)
+		}
+		expected := "Warning InvalidAnnotation Invalid annotation: invalid annotation 'ats.ingress.kubernetes.io/backend-protocol': \"" + protocol + "\" is not HTTP, HTTPS, H2C, GRPC nor GRPCS"
+		if returned := <-recorder.Events; returned != expected {
+			t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+		}
+	}
+}
+
+func TestUpdate_InvalidAnnotationReportedOnce(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	recorder := record.NewFakeRecorder(10)
+	igHandler.Recorder = recorder
+	exampleIngress := createExampleIngress()
+	exampleIngress.Annotations = map[string]string{util.AnnotationBackendProtocol: "SPDY"}
+
+	igHandler.add(&exampleIngress)
+
+	// neither an update keeping the annotation nor computing the routes
+	// again, as resyncs and reconciliations do, report it again
+	newIngress := exampleIngress.DeepCopy()
+	newIngress.ResourceVersion = "2"
+	igHandler.update(&exampleIngress, newIngress)
+	igHandler.routes(newIngress, igHandler.getBackend)
+
+	// a new invalid value is reported
+	newerIngress := newIngress.DeepCopy()
+	newerIngress.Annotations = map[string]string{util.AnnotationBackendProtocol: "SPDY/3"}
+	igHandler.update(newIngress, newerIngress)
+
+	var returned []string
+	for len(recorder.Events) > 0 {
+		returned = append(returned, <-recorder.Events)
+	}
+	expected := []string{
+		"Warning InvalidAnnotation Invalid annotation: invalid annotation 'ats.ingress.kubernetes.io/backend-protocol': \"SPDY\" is not HTTP, HTTPS, H2C, GRPC nor GRPCS",
+		"Warning InvalidAnnotation Invalid annotation: invalid annotation 'ats.ingress.kubernetes.io/backend-protocol': \"SPDY/3\" is not HTTP, HTTPS, H2C, GRPC nor GRPCS",
+	}
+
+	if !reflect.DeepEqual(returned, expected) {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+}
+
+func TestAdd_ProxySSL(t *testing.T) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	igHandler.CertDir = "/certs"
+	exampleIngress.Annotations = map[string]string{
+		util.AnnotationProxySSLCASecret:     "backend-ca",
+		util.AnnotationProxySSLName:         "appsvc.internal",
+		util.AnnotationProxySSLClientSecret: "backend-client",
+	}
+
+	igHandler.add(&exampleIngress)
+
+	returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	for hostPath := range expectedKeys {
+		expectedKeys[hostPath] = append(expectedKeys[hostPath],
+			"@trafficserver-test/example-ingress/proxy-ssl-ca=/certs/trafficserver-test_backend-ca_ca.crt",
+			"@trafficserver-test/example-ingress/proxy-ssl-name=appsvc.internal",
+			"@trafficserver-test/example-ingress/proxy-ssl-cert=/certs/trafficserver-test_backend-client.crt",
+			"@trafficserver-test/example-ingress/proxy-ssl-key=/certs/trafficserver-test_backend-client.key")
+	}
 
 	if !util.IsSameMap(returnedKeys, expectedKeys) {
 		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
 	}
+}
+
+func TestAdd_TimeoutsAndRetries(t *testing.T) {
+	for _, test := range []struct {
+		ann      map[string]string
+		expected []string
+	}{
+		{map[string]string{
+			util.AnnotationConnectTimeout: "5",
+			util.AnnotationReadTimeout:    "1m30s",
+			util.AnnotationRetries:        "2",
+			util.AnnotationRetryOn:        "connect-failure, 5xx",
+		}, []string{"@trafficserver-test/example-ingress/connect-timeout=5", "@trafficserver-test/example-ingress/read-timeout=90", "@trafficserver-test/example-ingress/retries=2", "@trafficserver-test/example-ingress/retry-on=connect-failure,5xx"}},
+		// invalid ones are ignored
+		{map[string]string{util.AnnotationConnectTimeout: "0"}, nil},
+		{map[string]string{util.AnnotationReadTimeout: "soon"}, nil},
+		{map[string]string{util.AnnotationRetries: "11"}, nil},
+		{map[string]string{util.AnnotationRetries: "2", util.AnnotationRetryOn: "4xx"}, nil},
+		{map[string]string{util.AnnotationRetryOn: "5xx"}, nil},
+	} {
+		igHandler := createExampleIgHandler()
+		exampleIngress := createExampleIngress()
+
+		exampleIngress.Annotations = test.ann
+
+		igHandler.add(&exampleIngress)
+
+		returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+		expectedKeys := getExpectedKeysForAdd()
+		for hostPath := range expectedKeys {
+			expectedKeys[hostPath] = append(expectedKeys[hostPath], test.expected...)
+		}
+
+		if !util.IsSameMap(returnedKeys, expectedKeys) {
+			t.Errorf("%v: returned \n%v,  but expected \n%v", test.ann, returnedKeys, expectedKeys)
+		}
+	}
+}
 
+func TestAdd_Headers(t *testing.T) {
+	for _, test := range []struct {
+		ann      map[string]string
+		expected []string
+	}{
+		{map[string]string{
+			util.AnnotationRequestHeadersSet:     "X-Forwarded-Prefix: /app\nX-Client: $client_ip\n",
+			util.AnnotationRequestHeadersRemove:  "Cookie",
+			util.AnnotationResponseHeadersAppend: "Via: ats",
+			util.AnnotationResponseHeadersRemove: "Server, X-Powered-By",
+		}, []string{"@trafficserver-test/example-ingress/request-header-set:X-Forwarded-Prefix=/app", "@trafficserver-test/example-ingress/request-header-set:X-Client=$client_ip",
+			"@trafficserver-test/example-ingress/request-header-remove:Cookie=", "@trafficserver-test/example-ingress/response-header-append:Via=ats", "@trafficserver-test/example-ingress/response-header-remove:Server=", "@trafficserver-test/example-ingress/response-header-remove:X-Powered-By="}},
+		// invalid ones are ignored
+		{map[string]string{util.AnnotationRequestHeadersSet: "X-Forwarded-Prefix /app"}, nil},
+		{map[string]string{util.AnnotationRequestHeadersSet: "X-User: $user"}, nil},
+		{map[string]string{util.AnnotationRequestHeadersSet: "X-Tenant: a\nx-tenant: b"}, nil},
+		{map[string]string{util.AnnotationResponseHeadersSet: "X-Tab: a\tb"}, nil},
+		{map[string]string{util.AnnotationResponseHeadersRemove: "Server,"}, nil},
+	} {
+		igHandler := createExampleIgHandler()
+		exampleIngress := createExampleIngress()
+
+		exampleIngress.Annotations = test.ann
+
+		igHandler.add(&exampleIngress)
+
+		returnedKeys := igHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+		expectedKeys := getExpectedKeysForAdd()
+		for hostPath := range expectedKeys {
+			expectedKeys[hostPath] = append(expectedKeys[hostPath], test.expected...)
+		}
+
+		if !util.IsSameMap(returnedKeys, expectedKeys) {
+			t.Errorf("%v: returned \n%v,  but expected \n%v", test.ann, returnedKeys, expectedKeys)
+		}
+	}
 }
 
 func createExampleIngressWithTLS() nv1.Ingress {
@@ -301,9 +1248,28 @@ func createExampleIngress() nv1.Ingress {
 	return exampleIngress
 }
 
+func createExampleIngressClass(name, controller string, isDefault bool) nv1.IngressClass {
+	class := nv1.IngressClass{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name},
+		Spec:       nv1.IngressClassSpec{Controller: controller},
+	}
+	if isDefault {
+		class.Annotations = map[string]string{nv1.AnnotationIsDefaultIngressClass: "true"}
+	}
+	return class
+}
+
+func createExampleIngressClassLister(classes ...*nv1.IngressClass) netlisters.IngressClassLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, class := range classes {
+		_ = indexer.Add(class)
+	}
+	return netlisters.NewIngressClassLister(indexer)
+}
+
 func createExampleIgHandler() IgHandler {
 	exampleEndpoint := createExampleEndpoint()
-	igHandler := IgHandler{"ingresses", &exampleEndpoint}
+	igHandler := IgHandler{ResourceName: "ingresses", Ep: &exampleEndpoint, Controller: "trafficserver.apache.org/ingress-controller", Snippets: true}
 
 	return igHandler
 }
@@ -349,16 +1315,18 @@ func getExpectedKeysForUpdate_ModifySnippet() map[string][]string {
 	expectedKeys["E+http://test.edge.com/app1"] = expectedKeys["E+http://test.edge.com/app1"][:1]
 	expectedKeys["E+http://test.edge.com/app1"] = append(expectedKeys["E+http://test.edge.com/app1"], "$trafficserver-test/example-ingress/10")
 
+	delete(expectedKeys, "$trafficserver-test/example-ingress/")
+
 	return expectedKeys
 }
 
 func getExpectedKeysForUpdate_ModifyIngress() map[string][]string {
 	expectedKeys := getExpectedKeysForAdd()
 
-	expectedKeys["E+http://test.media.com/app2"] = []string{}
+	delete(expectedKeys, "E+http://test.media.com/app2")
 
 	expectedKeys["E+http://test.media.com/app2-modified"] = []string{}
-	expectedKeys["E+http://test.media.com/app2-modified"] = append(expectedKeys["E+http://test.media.com/app2"], "trafficserver-test:appsvc2:8080")
+	expectedKeys["E+http://test.media.com/app2-modified"] = append(expectedKeys["E+http://test.media.com/app2-modified"], "trafficserver-test:appsvc2:8080")
 
 	expectedKeys["E+http://test.edge.com/app1"] = []string{}
 	expectedKeys["E+http://test.edge.com/app1"] = append(expectedKeys["E+http://test.edge.com/app1"], "trafficserver-test:appsvc1-modified:9090")
@@ -369,7 +1337,7 @@ func getExpectedKeysForUpdate_ModifyIngress() map[string][]string {
 func getExpectedKeysForUpdate_DeleteService() map[string][]string {
 	expectedKeys := getExpectedKeysForAdd()
 
-	expectedKeys["E+http://test.media.com/app2"] = []string{}
+	delete(expectedKeys, "E+http://test.media.com/app2")
 
 	return expectedKeys
 }
@@ -0,0 +1,106 @@
+/*
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package watcher
+
+import (
+	"errors"
+	"log"
+	"reflect"
+
+	"github.com/apache/trafficserver-ingress-controller/endpoint"
+	"github.com/apache/trafficserver-ingress-controller/util"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// SvcHandler re-syncs the routes of Ingresses when the port mapping of the
+// Services they point at changes, and the endpoints of the Services when
+// their backend protocol does
+type SvcHandler struct {
+	ResourceName string
+	Ep           *endpoint.Endpoint
+	IgHandler    *IgHandler
+	// Endpoints rewrites the DB 0 sets of a Service. It is optional.
+	Endpoints endpointsSyncer
+}
+
+// endpointsSyncer is implemented by the handlers of Endpoints and
+// EndpointSlices
+type endpointsSyncer interface {
+	syncEndpoints(namespace, name string) error
+}
+
+// Add for EventHandler
+func (s *SvcHandler) Add(obj interface{}) {
+	_ = s.Sync(nil, obj)
+}
+
+// Update for EventHandler
+func (s *SvcHandler) Update(obj, newObj interface{}) {
+	_ = s.Sync(obj, newObj)
+}
+
+// Delete for EventHandler
+func (s *SvcHandler) Delete(obj interface{}) {
+	_ = s.Sync(obj, nil)
+}
+
+// Sync for Syncer
+func (s *SvcHandler) Sync(prev, cur interface{}) error {
+	svc, _ := prev.(*v1.Service)
+	newSvc, _ := cur.(*v1.Service)
+	if svc == nil && newSvc == nil {
+		log.Println("In ServiceHandler Sync; cannot cast to *v1.Service")
+		return nil
+	}
+
+	meta := newSvc
+	if meta == nil {
+		meta = svc
+	}
+	if !s.Ep.NsManager.IncludeNamespace(meta.GetNamespace()) {
+		return nil
+	}
+
+	var errs []error
+	if newSvc != nil && backendProtocol(svc) != backendProtocol(newSvc) {
+		if _, err := util.ExtractBackendProtocol(newSvc.GetAnnotations()); err != nil {
+			s.IgHandler.invalidAnnotation("Service", newSvc, err)
+		}
+		if s.Endpoints != nil {
+			errs = append(errs, s.Endpoints.syncEndpoints(newSvc.GetNamespace(), newSvc.GetName()))
+		}
+	}
+
+	if svc == nil || newSvc == nil || !reflect.DeepEqual(svc.Spec.Ports, newSvc.Spec.Ports) {
+		errs = append(errs, s.IgHandler.resyncService(svc, newSvc))
+	}
+	return errors.Join(errs...)
+}
+
+// backendProtocol returns the backend-protocol annotation of a Service, which
+// can be nil
+func backendProtocol(svc *v1.Service) string {
+	if svc == nil {
+		return ""
+	}
+	return svc.GetAnnotations()[util.AnnotationBackendProtocol]
+}
+
+// GetResourceName returns the resource name
+func (s *SvcHandler) GetResourceName() string {
+	return s.ResourceName
+}
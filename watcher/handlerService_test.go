@@ -0,0 +1,191 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher
+
+import (
+	"testing"
+
+	"github.com/apache/trafficserver-ingress-controller/util"
+
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	corelisters "k8s.io/client-go/listers/core/v1"
+	netlisters "k8s.io/client-go/listers/networking/v1"
+)
+
+func TestAdd_ServiceResyncsIngress(t *testing.T) {
+	svcHandler, svcIndexer := createExampleSvcHandler()
+	exampleIngress := createExampleIngress()
+
+	svcHandler.IgHandler.add(&exampleIngress)
+
+	svc := createExampleService("appsvc1", 8080, intstr.FromInt(9080))
+	_ = svcIndexer.Add(&svc)
+	svcHandler.Add(&svc)
+
+	returnedKeys := svcHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+http://test.edge.com/app1"] = []string{"trafficserver-test:appsvc1:9080"}
+	expectedKeys["E+http://test.media.com/app1"] = []string{"trafficserver-test:appsvc1:9080"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestUpdate_ServiceTargetPort(t *testing.T) {
+	svcHandler, svcIndexer := createExampleSvcHandler()
+	exampleIngress := createExampleIngress()
+
+	svc := createExampleService("appsvc1", 8080, intstr.FromInt(9080))
+	_ = svcIndexer.Add(&svc)
+	svcHandler.IgHandler.add(&exampleIngress)
+
+	newSvc := createExampleService("appsvc1", 8080, intstr.FromInt(9090))
+	_ = svcIndexer.Update(&newSvc)
+	svcHandler.Update(&svc, &newSvc)
+
+	returnedKeys := svcHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+	expectedKeys["E+http://test.edge.com/app1"] = []string{"trafficserver-test:appsvc1:9090"}
+	expectedKeys["E+http://test.media.com/app1"] = []string{"trafficserver-test:appsvc1:9090"}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestDelete_ServiceFallsBackToBackendPort(t *testing.T) {
+	svcHandler, svcIndexer := createExampleSvcHandler()
+	exampleIngress := createExampleIngress()
+
+	svc := createExampleService("appsvc1", 8080, intstr.FromInt(9080))
+	_ = svcIndexer.Add(&svc)
+	svcHandler.IgHandler.add(&exampleIngress)
+
+	_ = svcIndexer.Delete(&svc)
+	svcHandler.Delete(&svc)
+
+	returnedKeys := svcHandler.Ep.RedisClient.GetDBOneKeyValues()
+
+	expectedKeys := getExpectedKeysForAdd()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestUpdate_ServiceBackendProtocol(t *testing.T) {
+	svcHandler, svcIndexer := createExampleSvcHandler()
+	epHandler := createExampleEpHandler()
+	epHandler.Ep = svcHandler.Ep
+	epHandler.IgHandler = svcHandler.IgHandler
+	svcHandler.Endpoints = &epHandler
+
+	eps := createExampleBackendEndpoints("appsvc1", "main", 8080)
+	svcHandler.IgHandler.EpLister, _ = createExampleEndpointsLister(&eps)
+	svc := createExampleService("appsvc1", 8080, intstr.FromInt(8080))
+	_ = svcIndexer.Add(&svc)
+	epHandler.Add(&eps)
+
+	newSvc := createExampleService("appsvc1", 8080, intstr.FromInt(8080))
+	newSvc.Annotations = map[string]string{util.AnnotationBackendProtocol: "HTTPS"}
+	_ = svcIndexer.Update(&newSvc)
+	svcHandler.Update(&svc, &newSvc)
+
+	returnedKeys := svcHandler.Ep.RedisClient.GetDefaultDBKeyValues()
+
+	expectedKeys := map[string][]string{"trafficserver-test:appsvc1:8080": {"10.10.1.1#8080#https"}}
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestUpdate_ServiceInvalidBackendProtocolReportedOnce(t *testing.T) {
+	svcHandler, svcIndexer := createExampleSvcHandler()
+	recorder := record.NewFakeRecorder(10)
+	svcHandler.IgHandler.Recorder = recorder
+
+	svc := createExampleService("appsvc1", 8080, intstr.FromInt(8080))
+	svc.Annotations = map[string]string{util.AnnotationBackendProtocol: "SPDY"}
+	_ = svcIndexer.Add(&svc)
+	svcHandler.Add(&svc)
+
+	// neither an unchanged annotation nor the protocol lookups report it again
+	newSvc := svc.DeepCopy()
+	newSvc.Labels = map[string]string{"app": "appsvc1"}
+	_ = svcIndexer.Update(newSvc)
+	svcHandler.Update(&svc, newSvc)
+	svcHandler.IgHandler.serviceProtocol("trafficserver-test", "appsvc1")
+
+	if len(recorder.Events) != 1 {
+		t.Fatalf("returned %d events, but expected 1", len(recorder.Events))
+	}
+	expected := "Warning InvalidAnnotation Invalid annotation: invalid annotation 'ats.ingress.kubernetes.io/backend-protocol': \"SPDY\" is not HTTP, HTTPS, H2C, GRPC nor GRPCS"
+	if returned := <-recorder.Events; returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+}
+
+func createExampleSvcHandler() (SvcHandler, cache.Indexer) {
+	igHandler := createExampleIgHandler()
+	exampleIngress := createExampleIngress()
+
+	svcLister, svcIndexer := createExampleServiceLister()
+	igHandler.SvcLister = svcLister
+
+	igIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	_ = igIndexer.Add(&exampleIngress)
+	igHandler.IgLister = netlisters.NewIngressLister(igIndexer)
+
+	svcHandler := SvcHandler{ResourceName: "services", Ep: igHandler.Ep, IgHandler: &igHandler}
+
+	return svcHandler, svcIndexer
+}
+
+func createExampleServiceLister(svcs ...*v1.Service) (corelisters.ServiceLister, cache.Indexer) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, svc := range svcs {
+		_ = indexer.Add(svc)
+	}
+	return corelisters.NewServiceLister(indexer), indexer
+}
+
+func createExampleService(name string, port int32, targetPort intstr.IntOrString) v1.Service {
+	exampleService := v1.Service{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      name,
+			Namespace: "trafficserver-test",
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{
+					Name:       "main",
+					Port:       port,
+					TargetPort: targetPort,
+					Protocol:   "TCP",
+				},
+			},
+		},
+	}
+
+	return exampleService
+}
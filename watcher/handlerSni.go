@@ -101,16 +101,47 @@ type SniFile struct {
 
 // Add handles creation of Atssnipolicy
 func (h *AtsSniHandler) Add(obj interface{}) {
+	_ = h.Sync(nil, obj)
+}
+
+// Update handles updates of Atssnipolicy
+func (h *AtsSniHandler) Update(oldObj, newObj interface{}) {
+	_ = h.Sync(oldObj, newObj)
+}
+
+// Delete handles deletion of Atssnipolicy
+func (h *AtsSniHandler) Delete(obj interface{}) {
+	_ = h.Sync(obj, nil)
+}
+
+// Sync for Syncer
+func (h *AtsSniHandler) Sync(prev, cur interface{}) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	switch {
+	case prev == nil:
+		return h.add(cur)
+	case cur == nil:
+		return h.delete(prev)
+	default:
+		return h.update(prev, cur)
+	}
+}
+
+// GetResourceName returns the resource name
+func (h *AtsSniHandler) GetResourceName() string {
+	return h.ResourceName
+}
+
+func (h *AtsSniHandler) add(obj interface{}) error {
 	u := obj.(*unstructured.Unstructured)
 	log.Printf("[ADD] Ats Sni Policy: #%v", u)
 
 	newSni, found, err := unstructured.NestedSlice(u.Object, "spec", "sni")
 	if err != nil || !found {
 		log.Printf("Add: sni not found or error: %v", err)
-		return
+		return nil
 	}
 
 	sniFile := h.loadSniFile()
@@ -140,22 +171,20 @@ func (h *AtsSniHandler) Add(obj interface{}) {
 		}
 	}
 
-	h.writeSniFile(sniFile)
-	h.reloadSni()
+	if err := h.writeSniFile(sniFile); err != nil {
+		return err
+	}
+	return h.reloadSni()
 }
 
-// Update handles updates of Atssnipolicy
-func (h *AtsSniHandler) Update(oldObj, newObj interface{}) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
+func (h *AtsSniHandler) update(oldObj, newObj interface{}) error {
 	newU := newObj.(*unstructured.Unstructured)
 	log.Printf("[UPDATE] Atssnipolicy: #%v", newU)
 
 	newSni, found, err := unstructured.NestedSlice(newU.Object, "spec", "sni")
 	if err != nil || !found {
 		log.Printf("Update: sni not found or error: %v", err)
-		return
+		return nil
 	}
 
 	sniFile := h.loadSniFile()
@@ -190,15 +219,13 @@ func (h *AtsSniHandler) Update(oldObj, newObj interface{}) {
 	}
 
 	sniFile.Sni = updatedSni
-	h.writeSniFile(sniFile)
-	h.reloadSni()
+	if err := h.writeSniFile(sniFile); err != nil {
+		return err
+	}
+	return h.reloadSni()
 }
 
-// Delete handles deletion of Atssnipolicy
-func (h *AtsSniHandler) Delete(obj interface{}) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
+func (h *AtsSniHandler) delete(obj interface{}) error {
 	u := obj.(*unstructured.Unstructured)
 	log.Printf("[DELETE] Atssnipolicy: #%v", u)
 
@@ -207,7 +234,7 @@ func (h *AtsSniHandler) Delete(obj interface{}) {
 	sniList, found, err := unstructured.NestedSlice(u.Object, "spec", "sni")
 	if err != nil || !found {
 		log.Printf("Delete: sni not found or error: %v", err)
-		return
+		return nil
 	}
 
 	delMap := make(map[string]struct{})
@@ -228,8 +255,10 @@ func (h *AtsSniHandler) Delete(obj interface{}) {
 	}
 
 	sniFile.Sni = updatedSni
-	h.writeSniFile(sniFile)
-	h.reloadSni()
+	if err := h.writeSniFile(sniFile); err != nil {
+		return err
+	}
+	return h.reloadSni()
 }
 
 // loadSniFile reads existing sni.yaml
@@ -250,33 +279,36 @@ func (h *AtsSniHandler) loadSniFile() SniFile {
 }
 
 // writeSniFile writes sni.yaml atomically
-func (h *AtsSniHandler) writeSniFile(sniFile SniFile) {
+func (h *AtsSniHandler) writeSniFile(sniFile SniFile) error {
 	if len(sniFile.Sni) == 0 {
 		if err := os.WriteFile(h.FilePath, []byte{}, 0644); err != nil {
 			log.Printf("Failed to clear sni.yaml: %v", err)
+			return err
 		}
-		return
+		return nil
 	}
 	data, err := yaml.Marshal(&sniFile)
 	if err != nil {
 		log.Printf("Failed to marshal sni.yaml: %v", err)
-		return
+		return err
 	}
 	tmp := h.FilePath + ".tmp"
 	if err := os.WriteFile(tmp, data, 0644); err != nil {
 		log.Printf("Failed to write temp sni.yaml: %v", err)
-		return
+		return err
 	}
-	_ = os.Rename(tmp, h.FilePath)
+	return os.Rename(tmp, h.FilePath)
 }
 
 // reloadSni triggers ATS reload
-func (h *AtsSniHandler) reloadSni() {
+func (h *AtsSniHandler) reloadSni() error {
 	if h.Ep != nil && h.Ep.ATSManager != nil {
-		if msg, err := h.Ep.ATSManager.SniSet(); err != nil {
+		msg, err := h.Ep.ATSManager.SniSet()
+		if err != nil {
 			log.Printf("Failed to reload ATS SNI: %v", err)
-		} else {
-			log.Printf("ATS SNI reloaded: %s", msg)
+			return err
 		}
+		log.Printf("ATS SNI reloaded: %s", msg)
 	}
+	return nil
 }
@@ -0,0 +1,97 @@
+/*
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package watcher
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+// Leadership tells whether this replica leads the controller replicas.
+// Every replica syncs its own Redis and ATS, but only the leader writes
+// cluster-scoped state such as Ingress statuses. A nil Leadership always
+// leads, as when leader election is disabled.
+type Leadership struct {
+	mu        sync.Mutex
+	leading   bool
+	observers []func(leading bool)
+}
+
+// IsLeader tells if this replica may write cluster-scoped state
+func (l *Leadership) IsLeader() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leading
+}
+
+// SetLeading records whether this replica leads and tells the observers
+// when that changed
+func (l *Leadership) SetLeading(leading bool) {
+	l.mu.Lock()
+	changed := l.leading != leading
+	l.leading = leading
+	observers := append([]func(bool){}, l.observers...)
+	l.mu.Unlock()
+
+	if changed {
+		for _, f := range observers {
+			f(leading)
+		}
+	}
+}
+
+// OnChange has f called whenever this replica starts or stops leading
+func (l *Leadership) OnChange(f func(leading bool)) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.observers = append(l.observers, f)
+	l.mu.Unlock()
+}
+
+// leaderRecorder records Events only while this replica leads. Every replica
+// syncs the same resources, and would otherwise post the same Events.
+type leaderRecorder struct {
+	record.EventRecorder
+	leader *Leadership
+}
+
+// Event for record.EventRecorder
+func (r leaderRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if r.leader.IsLeader() {
+		r.EventRecorder.Event(object, eventtype, reason, message)
+	}
+}
+
+// Eventf for record.EventRecorder
+func (r leaderRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if r.leader.IsLeader() {
+		r.EventRecorder.Eventf(object, eventtype, reason, messageFmt, args...)
+	}
+}
+
+// AnnotatedEventf for record.EventRecorder
+func (r leaderRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	if r.leader.IsLeader() {
+		r.EventRecorder.AnnotatedEventf(object, annotations, eventtype, reason, messageFmt, args...)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestLeadership_Disabled(t *testing.T) {
+	var leadership *Leadership
+
+	if !leadership.IsLeader() {
+		t.Errorf("returned not leading, but expected a nil Leadership to lead")
+	}
+}
+
+func TestLeadership_OnChange(t *testing.T) {
+	leadership := &Leadership{}
+	var changes []bool
+	leadership.OnChange(func(leading bool) {
+		changes = append(changes, leading)
+	})
+
+	if leadership.IsLeader() {
+		t.Errorf("returned leading, but expected not to lead before being elected")
+	}
+
+	leadership.SetLeading(true)
+	leadership.SetLeading(true)
+	leadership.SetLeading(false)
+
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Errorf("returned changes %v, but expected [true false]", changes)
+	}
+}
+
+func TestLeaderRecorder(t *testing.T) {
+	leadership := &Leadership{}
+	fake := record.NewFakeRecorder(10)
+	recorder := leaderRecorder{EventRecorder: fake, leader: leadership}
+	secret := &v1.Secret{}
+
+	recorder.Eventf(secret, v1.EventTypeNormal, "Reloaded", "Reloaded %s", "before")
+	leadership.SetLeading(true)
+	recorder.Eventf(secret, v1.EventTypeNormal, "Reloaded", "Reloaded %s", "after")
+
+	if len(fake.Events) != 1 {
+		t.Fatalf("returned %d events, but expected 1", len(fake.Events))
+	}
+	expected := "Normal Reloaded Reloaded after"
+	if returned := <-fake.Events; returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+}
@@ -0,0 +1,38 @@
+/*
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package watcher
+
+import (
+	"github.com/apache/trafficserver-ingress-controller/endpoint"
+)
+
+// Publisher implements Syncer. The handlers write their changes to DB 0
+// and DB 1, which the Publisher hands over to the router as a new
+// generation of the routing tables.
+type Publisher struct {
+	ResourceName string
+	Ep           *endpoint.Endpoint
+}
+
+// Sync for Syncer. There is no object to sync, the routing tables are.
+func (p *Publisher) Sync(_, _ interface{}) error {
+	return p.Ep.RedisClient.Publish()
+}
+
+// GetResourceName returns the resource name
+func (p *Publisher) GetResourceName() string {
+	return p.ResourceName
+}
@@ -0,0 +1,198 @@
+/*
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package watcher
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// maxSyncRetries is how many times a failing sync is retried before the
+// change is dropped
+const maxSyncRetries = 15
+
+// Syncer is implemented by the handlers whose events go through a Queue
+type Syncer interface {
+	GetResourceName() string
+	// Sync moves an object from prev to cur. prev is nil when the object is
+	// new and cur is nil when it is gone. A returned error makes the Queue
+	// retry the sync later.
+	Sync(prev, cur interface{}) error
+}
+
+// Queue hands informer events over to a rate limited workqueue, keyed by
+// resource and object. Events piling up on an object are synced once, from
+// the last state synced to the newest one, and failed syncs are retried
+// with backoff. Keys are synced one at a time, so the handlers sharing a
+// Queue never run concurrently.
+type Queue struct {
+	queue workqueue.RateLimitingInterface
+
+	mu       sync.Mutex
+	handlers map[string]Syncer
+	// latest is the newest state of the queued objects, nil once deleted
+	latest map[string]interface{}
+	// applied is the state of the objects as last synced
+	applied map[string]interface{}
+	// after is resynced whenever the Queue runs out of other keys
+	after Syncer
+}
+
+// NewQueue creates a Queue. Run must be called for it to sync anything.
+func NewQueue(name string) *Queue {
+	return &Queue{
+		queue: workqueue.NewRateLimitingQueueWithConfig(workqueue.DefaultControllerRateLimiter(),
+			workqueue.RateLimitingQueueConfig{Name: name}),
+		handlers: make(map[string]Syncer),
+		latest:   make(map[string]interface{}),
+		applied:  make(map[string]interface{}),
+	}
+}
+
+// EventHandlerFor returns the informer callbacks queueing the events of h
+func (q *Queue) EventHandlerFor(h Syncer) cache.ResourceEventHandlerFuncs {
+	q.mu.Lock()
+	q.handlers[h.GetResourceName()] = h
+	q.mu.Unlock()
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			q.enqueue(h, obj, false)
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			q.enqueue(h, newObj, false)
+		},
+		DeleteFunc: func(obj interface{}) {
+			q.enqueue(h, obj, true)
+		},
+	}
+}
+
+// Resync queues a sync of h that is not about any object, such as a full
+// reconciliation. Resyncs queued while one is waiting are run once.
+func (q *Queue) Resync(h Syncer) {
+	key := h.GetResourceName() + "/"
+
+	q.mu.Lock()
+	q.handlers[h.GetResourceName()] = h
+	q.latest[key] = time.Now()
+	q.mu.Unlock()
+
+	q.queue.Add(key)
+}
+
+// AddAfter queues a sync of h to cur once delay has passed, keyed by key
+// like the objects of h
+func (q *Queue) AddAfter(h Syncer, key string, cur interface{}, delay time.Duration) {
+	key = h.GetResourceName() + "/" + key
+
+	q.mu.Lock()
+	q.handlers[h.GetResourceName()] = h
+	q.latest[key] = cur
+	q.mu.Unlock()
+
+	q.queue.AddAfter(key, delay)
+}
+
+// SyncAfter has h resynced each time the Queue has synced the keys it
+// holds, so that h sees the outcome of bursts of events at once
+func (q *Queue) SyncAfter(h Syncer) {
+	q.mu.Lock()
+	q.after = h
+	q.mu.Unlock()
+}
+
+func (q *Queue) enqueue(h Syncer, obj interface{}, deleted bool) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Printf("Cannot queue %s event: %v", h.GetResourceName(), err)
+		return
+	}
+	key = h.GetResourceName() + "/" + key
+
+	q.mu.Lock()
+	if deleted {
+		q.latest[key] = nil
+	} else {
+		q.latest[key] = obj
+	}
+	q.mu.Unlock()
+
+	q.queue.Add(key)
+}
+
+// Run syncs the queued keys until stopCh is closed
+func (q *Queue) Run(stopCh <-chan struct{}) {
+	go func() {
+		<-stopCh
+		q.queue.ShutDown()
+	}()
+
+	for q.processNextItem() {
+	}
+}
+
+func (q *Queue) processNextItem() bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+
+	key := item.(string)
+	resource, _, _ := strings.Cut(key, "/")
+
+	q.mu.Lock()
+	h := q.handlers[resource]
+	cur := q.latest[key]
+	prev := q.applied[key]
+	q.mu.Unlock()
+
+	if h != nil && (prev != nil || cur != nil) {
+		if err := h.Sync(prev, cur); err != nil {
+			if q.queue.NumRequeues(key) < maxSyncRetries {
+				log.Printf("Syncing %s failed, retrying: %v", key, err)
+				q.queue.AddRateLimited(key)
+				return true
+			}
+			log.Printf("Syncing %s failed %d times, dropping it: %v", key, maxSyncRetries+1, err)
+		}
+	}
+	q.queue.Forget(key)
+
+	q.mu.Lock()
+	if cur == nil {
+		delete(q.applied, key)
+		// unless the object came back in the meantime
+		if obj, ok := q.latest[key]; ok && obj == nil {
+			delete(q.latest, key)
+		}
+	} else {
+		q.applied[key] = cur
+	}
+	after := q.after
+	q.mu.Unlock()
+
+	if after != nil && resource != after.GetResourceName() && q.queue.Len() == 0 {
+		q.Resync(after)
+	}
+	return true
+}
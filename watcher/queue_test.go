@@ -0,0 +1,195 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestQueue_RetryFailedSync(t *testing.T) {
+	h := &fakeSyncer{failures: 2}
+	q := NewQueue("test")
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go q.Run(stopChan)
+
+	cm := createExampleQueueConfigMap("1")
+	q.EventHandlerFor(h).OnAdd(&cm, false)
+
+	waitFor(t, func() bool { return len(h.getSyncs()) == 3 })
+
+	for _, s := range h.getSyncs() {
+		if s.prev != nil || s.cur != &cm {
+			t.Errorf("synced %v -> %v, but expected nil -> %v", s.prev, s.cur, &cm)
+		}
+	}
+}
+
+func TestQueue_SyncFromLastApplied(t *testing.T) {
+	h := &fakeSyncer{}
+	q := NewQueue("test")
+	handler := q.EventHandlerFor(h)
+
+	cm := createExampleQueueConfigMap("1")
+	cm2 := createExampleQueueConfigMap("2")
+	cm3 := createExampleQueueConfigMap("3")
+
+	// events piling up before the queue runs are synced at once
+	handler.OnAdd(&cm, false)
+	handler.OnUpdate(&cm, &cm2)
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go q.Run(stopChan)
+
+	waitFor(t, func() bool { return len(h.getSyncs()) == 1 })
+
+	handler.OnUpdate(&cm2, &cm3)
+	handler.OnDelete(&cm3)
+
+	waitFor(t, func() bool { return len(h.getSyncs()) >= 2 })
+	time.Sleep(50 * time.Millisecond)
+
+	syncs := h.getSyncs()
+	if syncs[0].prev != nil || syncs[0].cur != &cm2 {
+		t.Errorf("first sync %v -> %v, but expected nil -> %v", syncs[0].prev, syncs[0].cur, &cm2)
+	}
+	last := syncs[len(syncs)-1]
+	if last.cur != nil {
+		t.Errorf("last sync %v -> %v, but expected a deletion", last.prev, last.cur)
+	}
+}
+
+func TestQueue_Resync(t *testing.T) {
+	h := &fakeSyncer{}
+	q := NewQueue("test")
+
+	// resyncs piling up before the queue runs are synced once
+	q.Resync(h)
+	q.Resync(h)
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go q.Run(stopChan)
+
+	waitFor(t, func() bool { return len(h.getSyncs()) == 1 })
+
+	q.Resync(h)
+
+	waitFor(t, func() bool { return len(h.getSyncs()) == 2 })
+}
+
+func TestQueue_SyncAfter(t *testing.T) {
+	h := &fakeSyncer{}
+	after := &fakeSyncer{name: "after"}
+	q := NewQueue("test")
+	q.SyncAfter(after)
+	handler := q.EventHandlerFor(h)
+
+	cm := createExampleQueueConfigMap("1")
+	cm2 := createExampleQueueConfigMap("2")
+	cm2.Name = "testcm2"
+
+	// after is synced once both are
+	handler.OnAdd(&cm, false)
+	handler.OnAdd(&cm2, false)
+
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go q.Run(stopChan)
+
+	waitFor(t, func() bool { return len(after.getSyncs()) == 1 })
+	if len(h.getSyncs()) != 2 {
+		t.Errorf("synced %d objects before after, but expected 2", len(h.getSyncs()))
+	}
+}
+
+func TestQueue_AddAfter(t *testing.T) {
+	h := &fakeSyncer{}
+	q := NewQueue("test")
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go q.Run(stopChan)
+
+	q.AddAfter(h, "trafficserver-test/testsvc", "trafficserver-test/testsvc", 50*time.Millisecond)
+	if len(h.getSyncs()) != 0 {
+		t.Errorf("synced %v before the delay", h.getSyncs())
+	}
+
+	waitFor(t, func() bool { return len(h.getSyncs()) == 1 })
+	if s := h.getSyncs()[0]; s.cur != "trafficserver-test/testsvc" {
+		t.Errorf("synced %v, but expected trafficserver-test/testsvc", s.cur)
+	}
+}
+
+type fakeSync struct {
+	prev, cur interface{}
+}
+
+type fakeSyncer struct {
+	name     string
+	mu       sync.Mutex
+	failures int
+	syncs    []fakeSync
+}
+
+func (f *fakeSyncer) GetResourceName() string {
+	if f.name != "" {
+		return f.name
+	}
+	return "configmaps"
+}
+
+func (f *fakeSyncer) Sync(prev, cur interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.syncs = append(f.syncs, fakeSync{prev, cur})
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func (f *fakeSyncer) getSyncs() []fakeSync {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeSync(nil), f.syncs...)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func createExampleQueueConfigMap(version string) v1.ConfigMap {
+	return v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:            "testcm",
+			Namespace:       "trafficserver",
+			ResourceVersion: version,
+		},
+	}
+}
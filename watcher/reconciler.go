@@ -0,0 +1,160 @@
+/*
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/apache/trafficserver-ingress-controller/endpoint"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Reconciler implements Syncer. Rather than applying the change of a single
+// object, it computes what DB 0 and DB 1 should hold from the listers and
+// applies the difference to Redis, clearing whatever missed events or
+// failed writes left behind.
+type Reconciler struct {
+	ResourceName string
+	Ep           *endpoint.Endpoint
+	// IgHandler provides the listers of the Ingresses and of their backends
+	IgHandler *IgHandler
+	// SliceHandler computes DB 0 from the EndpointSlices. Without it, DB 0
+	// is computed from the Endpoints in the EpLister of IgHandler.
+	SliceHandler *EpSliceHandler
+}
+
+// Sync for Syncer. There is no object to sync, the whole state is.
+func (r *Reconciler) Sync(_, _ interface{}) error {
+	return r.Reconcile()
+}
+
+// Reconcile brings DB 0 and DB 1 in line with the listers
+func (r *Reconciler) Reconcile() error {
+	log.Println("Reconciling Redis with the cluster state")
+
+	svcs, err := r.desiredDefaultDB()
+	if err != nil {
+		return err
+	}
+	hostPaths, err := r.desiredDBOne()
+	if err != nil {
+		return err
+	}
+
+	client := r.Ep.RedisClient
+	return errors.Join(
+		reconcileSets(client.GetDefaultDBKeyValues(), svcs, client.DefaultDBDel, client.DefaultDBSReplace),
+		reconcileSets(client.GetDBOneKeyValues(), hostPaths, client.DBOneDel, client.DBOneSReplace),
+	)
+}
+
+// desiredDefaultDB computes the DB 0 sets of the Services
+func (r *Reconciler) desiredDefaultDB() (map[string][]string, error) {
+	if r.SliceHandler != nil {
+		return r.SliceHandler.members()
+	}
+
+	members := make(map[string][]string)
+	if r.IgHandler.EpLister == nil {
+		return members, nil
+	}
+	epsList, err := r.IgHandler.EpLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("listing endpoints failed: %v", err)
+	}
+	for _, eps := range epsList {
+		if !r.Ep.NsManager.IncludeNamespace(eps.GetNamespace()) {
+			continue
+		}
+		protocol := r.IgHandler.serviceProtocol(eps.GetNamespace(), eps.GetName())
+		for key, ipports := range endpointsMembers(eps, protocol) {
+			members[key] = ipports
+		}
+	}
+	return members, nil
+}
+
+// desiredDBOne computes the DB 1 host/path sets and snippets of the Ingresses
+func (r *Reconciler) desiredDBOne() (map[string][]string, error) {
+	g := r.IgHandler
+	ingresses, err := g.IgLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("listing ingresses failed: %v", err)
+	}
+
+	members := make(map[string][]string)
+	seen := make(map[hostPathRoute]bool)
+	for _, ingressObj := range ingresses {
+		if !g.includeIngress(ingressObj) {
+			continue
+		}
+		if snippet, ok, _ := g.snippet(ingressObj); ok {
+			members[nameVersion(ingressObj)] = []string{snippet}
+		}
+		for _, route := range g.routes(ingressObj, g.getBackend) {
+			if !seen[route] {
+				seen[route] = true
+				members[route.hostPath] = append(members[route.hostPath], route.member)
+			}
+		}
+	}
+	return members, nil
+}
+
+// reconcileSets deletes the keys of current that are not desired and
+// replaces the sets whose members differ. Empty desired sets stand for
+// absent keys, as Redis drops the sets losing their last member.
+func reconcileSets(current, desired map[string][]string, del func(key string) error, replace func(key string, members []string) error) error {
+	var errs []error
+	for key := range current {
+		if len(desired[key]) == 0 {
+			log.Printf("Reconcile: deleting stale key %s", key)
+			errs = append(errs, del(key))
+		}
+	}
+	for key, members := range desired {
+		if len(members) == 0 || sameMembers(current[key], members) {
+			continue
+		}
+		log.Printf("Reconcile: replacing members of %s", key)
+		errs = append(errs, replace(key, members))
+	}
+	return errors.Join(errs...)
+}
+
+// sameMembers tells if two lists hold the same members, as sets
+func sameMembers(x, y []string) bool {
+	xs := make(map[string]bool, len(x))
+	for _, m := range x {
+		xs[m] = true
+	}
+	ys := make(map[string]bool, len(y))
+	for _, m := range y {
+		if !xs[m] {
+			return false
+		}
+		ys[m] = true
+	}
+	return len(xs) == len(ys)
+}
+
+// GetResourceName returns the resource name
+func (r *Reconciler) GetResourceName() string {
+	return r.ResourceName
+}
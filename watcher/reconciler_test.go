@@ -0,0 +1,144 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher
+
+import (
+	"testing"
+
+	"github.com/apache/trafficserver-ingress-controller/util"
+
+	"k8s.io/client-go/tools/cache"
+
+	netlisters "k8s.io/client-go/listers/networking/v1"
+)
+
+func TestReconcile_RemoveStaleKeys(t *testing.T) {
+	reconciler, igIndexer := createExampleReconciler()
+	exampleIngress := createExampleIngress()
+	_ = igIndexer.Add(&exampleIngress)
+
+	exampleV1Endpoint := createExampleV1Endpoint()
+	reconciler.IgHandler.EpLister, _ = createExampleEndpointsLister(&exampleV1Endpoint)
+
+	rClient := reconciler.Ep.RedisClient
+	_ = rClient.DBOneSAdd("E+http://test.media.com/app1", "trafficserver-test:appsvc1:8080")
+	_ = rClient.DBOneSAdd("E+http://test.media.com/app2", "trafficserver-test:appsvc1:9090")
+	_ = rClient.DBOneSAdd("temp_E+http://test.media.com/app2", "trafficserver-test:appsvc2:8080")
+	_ = rClient.DBOneSAdd("E+http://test.media.com/removed", "trafficserver-test:appsvc3:8080")
+	_ = rClient.DBOneSAdd("$trafficserver-test/example-ingress/1", getExampleSnippet())
+	_ = rClient.DefaultDBSAdd("trafficserver-test-2:testsvc:8080", "10.10.3.3#8080#http")
+	_ = rClient.DefaultDBSAdd("trafficserver-test-2:removed:8080", "10.10.4.4#8080#http")
+
+	if err := reconciler.Reconcile(); err != nil {
+		t.Fatalf("Reconcile returned %v", err)
+	}
+
+	returnedKeys := rClient.GetDBOneKeyValues()
+	expectedKeys := getExpectedKeysForAdd()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+
+	returnedKeys = rClient.GetDefaultDBKeyValues()
+	expectedKeys = getExpectedKeysForEndpointAdd()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestReconcile_Snippet(t *testing.T) {
+	reconciler, igIndexer := createExampleReconciler()
+	exampleIngress := createExampleIngressWithAnnotation()
+	_ = igIndexer.Add(&exampleIngress)
+
+	if err := reconciler.Reconcile(); err != nil {
+		t.Fatalf("Reconcile returned %v", err)
+	}
+
+	returnedKeys := reconciler.Ep.RedisClient.GetDBOneKeyValues()
+	expectedKeys := getExpectedKeysForAddWithAnnotation()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestReconcile_EndpointSlices(t *testing.T) {
+	reconciler, _ := createExampleReconciler()
+	sliceHandler, indexer := createExampleEpSliceHandler()
+	sliceHandler.Ep = reconciler.Ep
+	reconciler.SliceHandler = sliceHandler
+
+	slice := createExampleEndpointSlice("testsvc-abc", "10.10.1.1")
+	slice2 := createExampleEndpointSlice("testsvc-def", "10.10.2.2")
+	_ = indexer.Add(&slice)
+	_ = indexer.Add(&slice2)
+
+	_ = reconciler.Ep.RedisClient.DefaultDBSAdd("trafficserver-test-2:testsvc:8081", "10.10.1.1#8081#http")
+
+	if err := reconciler.Reconcile(); err != nil {
+		t.Fatalf("Reconcile returned %v", err)
+	}
+
+	returnedKeys := reconciler.Ep.RedisClient.GetDefaultDBKeyValues()
+	expectedKeys := getExpectedKeysForEndpointAdd()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+}
+
+func TestReconcile_IngressClassChanged(t *testing.T) {
+	reconciler, igIndexer := createExampleReconciler()
+	exampleIngress := createExampleIngress()
+	className := "ats"
+	exampleIngress.Spec.IngressClassName = &className
+	_ = igIndexer.Add(&exampleIngress)
+
+	class := createExampleIngressClass("ats", "trafficserver.apache.org/ingress-controller", false)
+	reconciler.IgHandler.ClassLister = createExampleIngressClassLister(&class)
+
+	if err := reconciler.Reconcile(); err != nil {
+		t.Fatalf("Reconcile returned %v", err)
+	}
+
+	returnedKeys := reconciler.Ep.RedisClient.GetDBOneKeyValues()
+	expectedKeys := getExpectedKeysForAdd()
+
+	if !util.IsSameMap(returnedKeys, expectedKeys) {
+		t.Errorf("returned \n%v,  but expected \n%v", returnedKeys, expectedKeys)
+	}
+
+	class.Spec.Controller = "k8s.io/ingress-nginx"
+	reconciler.IgHandler.ClassLister = createExampleIngressClassLister(&class)
+
+	if err := reconciler.Reconcile(); err != nil {
+		t.Fatalf("Reconcile returned %v", err)
+	}
+
+	if returnedKeys := reconciler.Ep.RedisClient.GetDBOneKeyValues(); len(returnedKeys) != 0 {
+		t.Errorf("returned \n%v,  but expected no keys", returnedKeys)
+	}
+}
+
+func createExampleReconciler() (*Reconciler, cache.Indexer) {
+	igHandler := createExampleIgHandler()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	igHandler.IgLister = netlisters.NewIngressLister(indexer)
+	reconciler := &Reconciler{ResourceName: "reconcile", Ep: igHandler.Ep, IgHandler: &igHandler}
+
+	return reconciler, indexer
+}
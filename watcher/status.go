@@ -0,0 +1,240 @@
+/*
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	nv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// StatusUpdater implements Syncer. It publishes the addresses ATS is
+// reachable at to status.loadBalancer of the Ingresses the controller
+// admits, and clears them from those it stops admitting.
+type StatusUpdater struct {
+	ResourceName string
+	Cs           kubernetes.Interface
+	// IgHandler tells which Ingresses are admitted and provides the listers
+	IgHandler *IgHandler
+	// Addresses is a fixed list of IPs or hostnames to publish. It takes
+	// precedence over PublishService.
+	Addresses []string
+	// PublishService is the namespace/name of the ATS Service. Its external
+	// IPs are published or, lacking any, the IPs of the nodes running it.
+	PublishService string
+	// NodeLister provides the Nodes running the PublishService
+	NodeLister corelisters.NodeLister
+	// Leader gates the status writes
+	Leader *Leadership
+}
+
+// Sync for Syncer. A resync, which is about no Ingress in particular,
+// updates all of them.
+func (s *StatusUpdater) Sync(_, cur interface{}) error {
+	if !s.Leader.IsLeader() {
+		return nil
+	}
+
+	addresses, err := s.addresses()
+	if err != nil {
+		return err
+	}
+
+	if ingressObj, ok := cur.(*nv1.Ingress); ok {
+		return s.updateStatus(ingressObj, addresses)
+	}
+	if cur != nil {
+		ingresses, err := s.IgHandler.IgLister.List(labels.Everything())
+		if err != nil {
+			return fmt.Errorf("listing ingresses failed: %v", err)
+		}
+		var errs []error
+		for _, ingressObj := range ingresses {
+			errs = append(errs, s.updateStatus(ingressObj, addresses))
+		}
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// updateStatus writes addresses to the status of an admitted Ingress. The
+// status of other Ingresses is cleared when it holds addresses, as they
+// were admitted before.
+func (s *StatusUpdater) updateStatus(ingressObj *nv1.Ingress, addresses []nv1.IngressLoadBalancerIngress) error {
+	current := ingressObj.Status.LoadBalancer.Ingress
+	if !s.IgHandler.includeIngress(ingressObj) {
+		if len(current) == 0 || !sameAddresses(current, addresses) {
+			return nil
+		}
+		addresses = nil
+	} else if sameAddresses(current, addresses) {
+		return nil
+	}
+
+	log.Printf("Updating status of ingress %s/%s to %v", ingressObj.GetNamespace(), ingressObj.GetName(), addresses)
+	updated := ingressObj.DeepCopy()
+	updated.Status.LoadBalancer.Ingress = addresses
+	_, err := s.Cs.NetworkingV1().Ingresses(updated.GetNamespace()).UpdateStatus(context.TODO(), updated, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("updating status of ingress %s/%s failed: %v", updated.GetNamespace(), updated.GetName(), err)
+	}
+	return nil
+}
+
+// addresses returns the sorted addresses to publish
+func (s *StatusUpdater) addresses() ([]nv1.IngressLoadBalancerIngress, error) {
+	var addresses []nv1.IngressLoadBalancerIngress
+	add := func(address string) {
+		if net.ParseIP(address) != nil {
+			addresses = append(addresses, nv1.IngressLoadBalancerIngress{IP: address})
+		} else if address != "" {
+			addresses = append(addresses, nv1.IngressLoadBalancerIngress{Hostname: address})
+		}
+	}
+
+	if len(s.Addresses) > 0 {
+		for _, address := range s.Addresses {
+			add(address)
+		}
+		return sortAddresses(addresses), nil
+	}
+
+	namespace, name, ok := strings.Cut(s.PublishService, "/")
+	if !ok {
+		return nil, fmt.Errorf("publish service %q is not namespace/name", s.PublishService)
+	}
+	svc, err := s.IgHandler.SvcLister.Services(namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("getting publish service %s failed: %v", s.PublishService, err)
+	}
+
+	for _, lb := range svc.Status.LoadBalancer.Ingress {
+		add(lb.IP)
+		add(lb.Hostname)
+	}
+	for _, ip := range svc.Spec.ExternalIPs {
+		add(ip)
+	}
+	if len(addresses) > 0 {
+		return sortAddresses(addresses), nil
+	}
+
+	nodes, err := s.nodeNames(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	for nodeName := range nodes {
+		node, err := s.NodeLister.Get(nodeName)
+		if err != nil {
+			return nil, fmt.Errorf("getting node %s failed: %v", nodeName, err)
+		}
+		add(nodeAddress(node))
+	}
+	return sortAddresses(addresses), nil
+}
+
+// nodeNames returns the names of the nodes running the endpoints of a Service
+func (s *StatusUpdater) nodeNames(namespace, name string) (map[string]bool, error) {
+	nodes := make(map[string]bool)
+	switch g := s.IgHandler; {
+	case g.SliceLister != nil:
+		slices, err := g.SliceLister.EndpointSlices(namespace).List(serviceSelector(name))
+		if err != nil {
+			return nil, fmt.Errorf("listing endpointslices of %s/%s failed: %v", namespace, name, err)
+		}
+		for _, slice := range slices {
+			for _, ep := range slice.Endpoints {
+				if ep.NodeName != nil {
+					nodes[*ep.NodeName] = true
+				}
+			}
+		}
+	case g.EpLister != nil:
+		eps, err := g.EpLister.Endpoints(namespace).Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("getting endpoints of %s/%s failed: %v", namespace, name, err)
+		}
+		for _, subset := range eps.Subsets {
+			for _, addr := range subset.Addresses {
+				if addr.NodeName != nil {
+					nodes[*addr.NodeName] = true
+				}
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// GetResourceName returns the resource name
+func (s *StatusUpdater) GetResourceName() string {
+	return s.ResourceName
+}
+
+// nodeAddress returns the external IP of a node, or its internal one
+func nodeAddress(node *v1.Node) string {
+	internal := ""
+	for _, addr := range node.Status.Addresses {
+		switch addr.Type {
+		case v1.NodeExternalIP:
+			return addr.Address
+		case v1.NodeInternalIP:
+			if internal == "" {
+				internal = addr.Address
+			}
+		}
+	}
+	return internal
+}
+
+func sortAddresses(addresses []nv1.IngressLoadBalancerIngress) []nv1.IngressLoadBalancerIngress {
+	sort.Slice(addresses, func(i, j int) bool {
+		if addresses[i].IP != addresses[j].IP {
+			return addresses[i].IP < addresses[j].IP
+		}
+		return addresses[i].Hostname < addresses[j].Hostname
+	})
+	return addresses
+}
+
+// sameAddresses tells if two lists hold the same IPs and hostnames
+func sameAddresses(x, y []nv1.IngressLoadBalancerIngress) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	key := func(a nv1.IngressLoadBalancerIngress) string { return a.IP + "/" + a.Hostname }
+	xs := make(map[string]int, len(x))
+	for _, a := range x {
+		xs[key(a)]++
+	}
+	for _, a := range y {
+		if xs[key(a)] == 0 {
+			return false
+		}
+		xs[key(a)]--
+	}
+	return true
+}
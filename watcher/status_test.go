@@ -0,0 +1,162 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/apache/trafficserver-ingress-controller/proxy"
+
+	v1 "k8s.io/api/core/v1"
+	nv1 "k8s.io/api/networking/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	pkgruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	fake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestSync_PublishStatusAddresses(t *testing.T) {
+	exampleIngress := createExampleIngress()
+	updater := createExampleStatusUpdater(&exampleIngress)
+	updater.Addresses = []string{"ats.example.com", "10.0.0.2", "10.0.0.1"}
+
+	if err := updater.Sync(nil, &exampleIngress); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	returned := getExampleIngressStatus(t, updater)
+	expected := []nv1.IngressLoadBalancerIngress{{Hostname: "ats.example.com"}, {IP: "10.0.0.1"}, {IP: "10.0.0.2"}}
+
+	if !reflect.DeepEqual(returned, expected) {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+}
+
+func TestSync_PublishServiceExternalIPs(t *testing.T) {
+	exampleIngress := createExampleIngress()
+	updater := createExampleStatusUpdater(&exampleIngress)
+
+	atsSvc := createExampleService("ats", 80, intstr.FromInt(8080))
+	atsSvc.Spec.ExternalIPs = []string{"192.168.0.1"}
+	atsSvc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{Hostname: "lb.example.com"}}
+	updater.IgHandler.SvcLister, _ = createExampleServiceLister(&atsSvc)
+	updater.PublishService = "trafficserver-test/ats"
+
+	if err := updater.Sync(nil, &exampleIngress); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	returned := getExampleIngressStatus(t, updater)
+	expected := []nv1.IngressLoadBalancerIngress{{Hostname: "lb.example.com"}, {IP: "192.168.0.1"}}
+
+	if !reflect.DeepEqual(returned, expected) {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+}
+
+func TestSync_PublishServiceNodeIPs(t *testing.T) {
+	exampleIngress := createExampleIngress()
+	node := v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "node-1"},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeInternalIP, Address: "10.1.0.1"},
+				{Type: v1.NodeExternalIP, Address: "203.0.113.1"},
+			},
+		},
+	}
+	// the node is only in the cache, not read from the API
+	updater := createExampleStatusUpdater(&exampleIngress)
+	updater.NodeLister = createExampleNodeLister(&node)
+
+	atsSvc := createExampleService("ats", 80, intstr.FromInt(8080))
+	updater.IgHandler.SvcLister, _ = createExampleServiceLister(&atsSvc)
+	atsEps := createExampleBackendEndpoints("ats", "main", 8080)
+	nodeName := "node-1"
+	atsEps.Subsets[0].Addresses[0].NodeName = &nodeName
+	updater.IgHandler.EpLister, _ = createExampleEndpointsLister(&atsEps)
+	updater.PublishService = "trafficserver-test/ats"
+
+	if err := updater.Sync(nil, &exampleIngress); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	returned := getExampleIngressStatus(t, updater)
+	expected := []nv1.IngressLoadBalancerIngress{{IP: "203.0.113.1"}}
+
+	if !reflect.DeepEqual(returned, expected) {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+}
+
+func TestSync_ClearStatusOfIngressNotAdmitted(t *testing.T) {
+	exampleIngress := createExampleIngress()
+	exampleIngress.Status.LoadBalancer.Ingress = []nv1.IngressLoadBalancerIngress{{IP: "10.0.0.1"}}
+	updater := createExampleStatusUpdater(&exampleIngress)
+	updater.Addresses = []string{"10.0.0.1"}
+	updater.IgHandler.Ep.ATSManager = &proxy.ATSManager{Namespace: "default", IngressClass: "ats"}
+
+	if err := updater.Sync(nil, &exampleIngress); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	if returned := getExampleIngressStatus(t, updater); len(returned) != 0 {
+		t.Errorf("returned \n%v,  but expected no addresses", returned)
+	}
+}
+
+func TestSync_StatusNotLeading(t *testing.T) {
+	exampleIngress := createExampleIngress()
+	updater := createExampleStatusUpdater(&exampleIngress)
+	updater.Addresses = []string{"10.0.0.1"}
+	updater.Leader = &Leadership{}
+
+	if err := updater.Sync(nil, &exampleIngress); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	if returned := getExampleIngressStatus(t, updater); len(returned) != 0 {
+		t.Errorf("returned \n%v,  but expected no addresses", returned)
+	}
+}
+
+func createExampleStatusUpdater(objects ...pkgruntime.Object) *StatusUpdater {
+	igHandler := createExampleIgHandler()
+
+	return &StatusUpdater{
+		ResourceName: "ingressstatus",
+		Cs:           fake.NewSimpleClientset(objects...),
+		IgHandler:    &igHandler,
+	}
+}
+
+func createExampleNodeLister(nodes ...*v1.Node) corelisters.NodeLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range nodes {
+		_ = indexer.Add(node)
+	}
+	return corelisters.NewNodeLister(indexer)
+}
+
+func getExampleIngressStatus(t *testing.T, updater *StatusUpdater) []nv1.IngressLoadBalancerIngress {
+	ingressObj, err := updater.Cs.NetworkingV1().Ingresses("trafficserver-test").Get(context.TODO(), "example-ingress", meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get returned %v", err)
+	}
+	return ingressObj.Status.LoadBalancer.Ingress
+}
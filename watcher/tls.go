@@ -0,0 +1,572 @@
+/*
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package watcher
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficserver-ingress-controller/endpoint"
+	"github.com/apache/trafficserver-ingress-controller/util"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// TLSManager implements Syncer. It writes the certificates of the Secrets
+// referenced by spec.tls of the admitted Ingresses to CertDir, with one
+// line each in ssl_multicert.config, and reloads ATS when they change. ATS
+// picks the certificate matching the SNI of a connection from those lines,
+// and falls back to the one of the dest_ip=* line. The CA and client
+// certificates of the proxy-ssl annotations are written to CertDir too, for
+// the router to point the connections to the backends at.
+type TLSManager struct {
+	ResourceName string
+	Ep           *endpoint.Endpoint
+	// IgHandler tells which Ingresses are admitted and lists them
+	IgHandler    *IgHandler
+	SecretLister corelisters.SecretLister
+	// CertDir holds the certificates and keys written, and nothing else
+	CertDir string
+	// ConfigPath is the path of ssl_multicert.config
+	ConfigPath string
+	// DefaultSecret is the namespace/name of the Secret of the certificate
+	// for connections matching no other one. Without it, the default lines
+	// found at startup are kept, and lacking any a self-signed certificate
+	// is generated.
+	DefaultSecret string
+	// Recorder reports the certificates reloaded or rejected as Events of
+	// their Secrets. It is optional, as they are logged anyway.
+	Recorder record.EventRecorder
+
+	mu sync.Mutex
+	// static are the lines of ConfigPath found at startup that are not
+	// about CertDir, e.g. those for the certificates mounted into the pod
+	static []string
+	loaded bool
+	// staticPairs holds the contents of the certificates and keys of the
+	// static lines, to tell when they are rotated
+	staticPairs map[string][]byte
+	// rejected holds the contents of the invalid Secrets last reported
+	rejected map[string][]byte
+	// selfSigned is the PEM certificate and key generated as the default
+	selfSigned [][]byte
+}
+
+// caCertKey is the key of the CA certificates in the data of Secrets
+const caCertKey = "ca.crt"
+
+// certificate is a key pair, or CA certificates without a key, written to
+// CertDir
+type certificate struct {
+	secret            *v1.Secret
+	certFile, keyFile string
+	notAfter          time.Time
+	changed           bool
+}
+
+// Sync for Syncer. Every sync, whatever its object, rewrites the
+// certificates of all the Ingresses.
+func (t *TLSManager) Sync(_, _ interface{}) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.loadStatic(); err != nil {
+		return err
+	}
+	if t.rejected == nil {
+		t.rejected = make(map[string][]byte)
+	}
+	if err := os.MkdirAll(t.CertDir, 0700); err != nil {
+		return fmt.Errorf("creating %s failed: %v", t.CertDir, err)
+	}
+
+	refs, caRefs, clientRefs, err := t.secretRefs()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	changed := t.staticChanged()
+	written := make(map[string]bool)
+	var lines []string
+	var certs []certificate
+	add := func(format string, cert certificate) {
+		changed = changed || cert.changed
+		written[filepath.Base(cert.certFile)] = true
+		if cert.keyFile != "" {
+			written[filepath.Base(cert.keyFile)] = true
+		}
+		if format != "" {
+			lines = append(lines, fmt.Sprintf(format, cert.certFile, cert.keyFile))
+		}
+		if cert.secret != nil {
+			certs = append(certs, cert)
+		}
+	}
+
+	staticDefault := false
+	for _, line := range t.static {
+		if isDefaultLine(line) {
+			staticDefault = true
+			if t.DefaultSecret != "" {
+				continue
+			}
+		}
+		lines = append(lines, line)
+	}
+	if t.DefaultSecret != "" || !staticDefault {
+		cert, err := t.writeDefault()
+		errs = append(errs, err)
+		if cert.certFile != "" {
+			add("dest_ip=* ssl_cert_name=%s ssl_key_name=%s", cert)
+		}
+	}
+
+	for _, ref := range refs {
+		// ATS also picks the default certificate by SNI
+		if ref == t.DefaultSecret {
+			continue
+		}
+		cert, err := t.writeSecret(ref)
+		errs = append(errs, err)
+		if cert.certFile != "" {
+			add("ssl_cert_name=%s ssl_key_name=%s", cert)
+		}
+	}
+
+	// presented to the backends only, so without lines
+	for _, ref := range clientRefs {
+		cert, err := t.writeSecret(ref)
+		errs = append(errs, err)
+		if cert.certFile != "" {
+			add("", cert)
+		}
+	}
+	for _, ref := range caRefs {
+		cert, err := t.writeCA(ref)
+		errs = append(errs, err)
+		if cert.certFile != "" {
+			add("", cert)
+		}
+	}
+
+	config := ""
+	if len(lines) > 0 {
+		config = strings.Join(lines, "\n") + "\n"
+	}
+	configChanged, err := writeIfChanged(t.ConfigPath, []byte(config), 0644)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	// ATS only reloads the certificates of a config file newer than its
+	// last reload, and the certificates are rewritten under the same names
+	if changed && !configChanged {
+		now := time.Now()
+		if err := os.Chtimes(t.ConfigPath, now, now); err != nil {
+			errs = append(errs, fmt.Errorf("touching %s failed: %v", t.ConfigPath, err))
+		}
+	}
+	changed = changed || configChanged
+
+	// certificates no Ingress refers to anymore
+	entries, err := os.ReadDir(t.CertDir)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reading %s failed: %v", t.CertDir, err))
+	}
+	for _, entry := range entries {
+		if !written[entry.Name()] {
+			errs = append(errs, os.Remove(filepath.Join(t.CertDir, entry.Name())))
+		}
+	}
+
+	if !changed {
+		return errors.Join(errs...)
+	}
+	msg, err := t.Ep.ATSManager.SslSet()
+	for _, cert := range certs {
+		if !cert.changed {
+			continue
+		}
+		ref := cert.secret.GetNamespace() + "/" + cert.secret.GetName()
+		if err != nil {
+			t.event(cert.secret, v1.EventTypeWarning, "ReloadFailed", "Failed to reload the certificate of secret %s: %v", ref, err)
+		} else {
+			t.event(cert.secret, v1.EventTypeNormal, "Reloaded", "Reloaded the certificate of secret %s, which expires at %s", ref, cert.notAfter.UTC().Format(time.RFC3339))
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to reload ATS certificates: %v", err)
+		return errors.Join(append(errs, err)...)
+	}
+	log.Printf("ATS certificates reloaded: %s", msg)
+	return errors.Join(errs...)
+}
+
+// loadStatic reads the lines of ConfigPath that are not about CertDir, once
+func (t *TLSManager) loadStatic() error {
+	if t.loaded {
+		return nil
+	}
+	data, err := os.ReadFile(t.ConfigPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("reading %s failed: %v", t.ConfigPath, err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) != "" && !strings.Contains(line, t.CertDir+string(filepath.Separator)) {
+			t.static = append(t.static, line)
+		}
+	}
+	t.loaded = true
+	t.staticChanged()
+	return nil
+}
+
+// staticChanged tells if a certificate or key of the static lines changed
+// on disk since the last call, as mounted Secrets do when rotated. A new
+// pair only counts once it is valid.
+func (t *TLSManager) staticChanged() bool {
+	first := t.staticPairs == nil
+	if first {
+		t.staticPairs = make(map[string][]byte)
+	}
+
+	changed := false
+	for _, line := range t.static {
+		var certFile, keyFile string
+		for _, field := range strings.Fields(line) {
+			if name, value, ok := strings.Cut(field, "="); ok {
+				switch name {
+				case "ssl_cert_name":
+					certFile = value
+				case "ssl_key_name":
+					keyFile = value
+				}
+			}
+		}
+		if certFile == "" || keyFile == "" {
+			continue
+		}
+		cert, certErr := os.ReadFile(certFile)
+		key, keyErr := os.ReadFile(keyFile)
+		if certErr != nil || keyErr != nil {
+			continue
+		}
+		if bytes.Equal(t.staticPairs[certFile], cert) && bytes.Equal(t.staticPairs[keyFile], key) {
+			continue
+		}
+		notAfter, err := validatePair(cert, key)
+		if err != nil {
+			log.Printf("Ignoring the certificate %s: %v", certFile, err)
+			continue
+		}
+		t.staticPairs[certFile], t.staticPairs[keyFile] = cert, key
+		if !first {
+			log.Printf("Certificate %s changed, it expires at %s", certFile, notAfter.UTC().Format(time.RFC3339))
+			changed = true
+		}
+	}
+	return changed
+}
+
+// secretRefs returns the sorted namespace/name of the Secrets referenced by
+// spec.tls of the admitted Ingresses, and by their proxy-ssl annotations
+func (t *TLSManager) secretRefs() (refs, caRefs, clientRefs []string, err error) {
+	ingresses, err := t.IgHandler.IgLister.List(labels.Everything())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("listing ingresses failed: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	appendRef := func(refs []string, kind, namespace, name string) []string {
+		ref := namespace + "/" + name
+		if name == "" || seen[kind+ref] {
+			return refs
+		}
+		seen[kind+ref] = true
+		return append(refs, ref)
+	}
+	for _, ingressObj := range ingresses {
+		if !t.IgHandler.includeIngress(ingressObj) {
+			continue
+		}
+		namespace := ingressObj.GetNamespace()
+		for _, tls := range ingressObj.Spec.TLS {
+			refs = appendRef(refs, "tls", namespace, tls.SecretName)
+		}
+		// the IgHandler logs the annotations that are not valid
+		if caSecret, _, clientSecret, err := util.ExtractProxySSL(ingressObj.GetAnnotations()); err == nil {
+			caRefs = appendRef(caRefs, "ca", namespace, caSecret)
+			clientRefs = appendRef(clientRefs, "client", namespace, clientSecret)
+		}
+	}
+	sort.Strings(refs)
+	sort.Strings(caRefs)
+	sort.Strings(clientRefs)
+	return refs, caRefs, clientRefs, nil
+}
+
+// writeSecret writes the certificate and key of a Secret to CertDir. A pair
+// that is not valid is not written, and the one written before, if any, is
+// kept in use.
+func (t *TLSManager) writeSecret(ref string) (certificate, error) {
+	namespace, name, _ := strings.Cut(ref, "/")
+	secret, err := t.SecretLister.Secrets(namespace).Get(name)
+	if err != nil {
+		return certificate{}, fmt.Errorf("getting secret %s failed: %v", ref, err)
+	}
+
+	certFile, keyFile, _ := secretFiles(t.CertDir, namespace, name)
+	c := certificate{secret: secret, certFile: certFile, keyFile: keyFile}
+
+	cert, key := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+	c.notAfter, err = validatePair(cert, key)
+	if err != nil {
+		err = fmt.Errorf("secret %s has no valid key pair: %v", ref, err)
+		// reported once per content
+		if rejected := append(append([]byte{}, cert...), key...); !bytes.Equal(t.rejected[ref], rejected) {
+			t.rejected[ref] = rejected
+			t.event(secret, v1.EventTypeWarning, "InvalidCertificate", "%v", err)
+		}
+		if _, statErr := os.Stat(c.keyFile); statErr != nil {
+			return certificate{}, err
+		}
+		return c, err
+	}
+	delete(t.rejected, ref)
+
+	certChanged, err := writeIfChanged(c.certFile, cert, 0644)
+	if err != nil {
+		return certificate{}, err
+	}
+	keyChanged, err := writeIfChanged(c.keyFile, key, 0600)
+	if err != nil {
+		return certificate{}, err
+	}
+	c.changed = certChanged || keyChanged
+	return c, nil
+}
+
+// writeCA writes the CA certificates of a Secret to CertDir. Certificates
+// that do not parse are not written, and the ones written before, if any,
+// are kept in use.
+func (t *TLSManager) writeCA(ref string) (certificate, error) {
+	namespace, name, _ := strings.Cut(ref, "/")
+	secret, err := t.SecretLister.Secrets(namespace).Get(name)
+	if err != nil {
+		return certificate{}, fmt.Errorf("getting secret %s failed: %v", ref, err)
+	}
+
+	_, _, caFile := secretFiles(t.CertDir, namespace, name)
+	c := certificate{secret: secret, certFile: caFile}
+
+	ca := secret.Data[caCertKey]
+	c.notAfter, err = validateCA(ca)
+	if err != nil {
+		err = fmt.Errorf("secret %s has no valid CA certificates: %v", ref, err)
+		if !bytes.Equal(t.rejected[caCertKey+ref], ca) {
+			t.rejected[caCertKey+ref] = ca
+			t.event(secret, v1.EventTypeWarning, "InvalidCertificate", "%v", err)
+		}
+		if _, statErr := os.Stat(c.certFile); statErr != nil {
+			return certificate{}, err
+		}
+		return c, err
+	}
+	delete(t.rejected, caCertKey+ref)
+
+	c.changed, err = writeIfChanged(c.certFile, ca, 0644)
+	if err != nil {
+		return certificate{}, err
+	}
+	return c, nil
+}
+
+// writeDefault writes the certificate of DefaultSecret to CertDir, or a
+// self-signed one when there is no usable DefaultSecret
+func (t *TLSManager) writeDefault() (certificate, error) {
+	var errs []error
+	if t.DefaultSecret != "" {
+		c, err := t.writeSecret(t.DefaultSecret)
+		if c.certFile != "" {
+			return c, err
+		}
+		log.Printf("Using a self-signed default certificate: %v", err)
+		errs = append(errs, err)
+	}
+
+	if t.selfSigned == nil {
+		cert, key, err := selfSignedCertificate()
+		if err != nil {
+			return certificate{}, errors.Join(append(errs, err)...)
+		}
+		t.selfSigned = [][]byte{cert, key}
+	}
+
+	base := filepath.Join(t.CertDir, "default")
+	c := certificate{certFile: base + ".crt", keyFile: base + ".key"}
+	certChanged, err := writeIfChanged(c.certFile, t.selfSigned[0], 0644)
+	if err != nil {
+		return certificate{}, errors.Join(append(errs, err)...)
+	}
+	keyChanged, err := writeIfChanged(c.keyFile, t.selfSigned[1], 0600)
+	if err != nil {
+		return certificate{}, errors.Join(append(errs, err)...)
+	}
+	c.changed = certChanged || keyChanged
+	return c, errors.Join(errs...)
+}
+
+// event logs a message about a Secret, and records it as an Event
+func (t *TLSManager) event(secret *v1.Secret, eventType, reason, messageFmt string, args ...interface{}) {
+	log.Printf(messageFmt, args...)
+	if t.Recorder != nil {
+		t.Recorder.Eventf(secret, eventType, reason, messageFmt, args...)
+	}
+}
+
+// GetResourceName returns the resource name
+func (t *TLSManager) GetResourceName() string {
+	return t.ResourceName
+}
+
+// isDefaultLine tells if a line of ssl_multicert.config is about the
+// default certificate
+func isDefaultLine(line string) bool {
+	for _, field := range strings.Fields(line) {
+		if field == "dest_ip=*" {
+			return true
+		}
+	}
+	return false
+}
+
+// selfSignedCertificate generates a PEM certificate and key for
+// connections that no certificate is configured for
+func selfSignedCertificate() (cert, key []byte, err error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating the self-signed key failed: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating the self-signed serial number failed: %v", err)
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ATS Ingress Controller Fake Certificate"},
+		DNSNames:              []string{"ingress.local"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating the self-signed certificate failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encoding the self-signed key failed: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// secretFiles returns the paths in dir of the certificate, key and CA
+// certificates of a Secret. Names cannot hold '_', so files of different
+// Secrets never collide.
+func secretFiles(dir, namespace, name string) (certFile, keyFile, caFile string) {
+	base := filepath.Join(dir, namespace+"_"+name)
+	return base + ".crt", base + ".key", base + "_ca.crt"
+}
+
+// validateCA checks that PEM data holds certificates only, at least one, and
+// returns the earliest time one of them expires
+func validateCA(data []byte) (time.Time, error) {
+	var notAfter time.Time
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return time.Time{}, fmt.Errorf("unexpected %s block", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if notAfter.IsZero() || cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	if notAfter.IsZero() {
+		return time.Time{}, errors.New("no certificate found")
+	}
+	return notAfter, nil
+}
+
+// validatePair checks that a certificate matches its key, and returns when
+// the certificate expires
+func validatePair(cert, key []byte) (time.Time, error) {
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return leaf.NotAfter, nil
+}
+
+// writeIfChanged atomically replaces the contents of a file that differ
+// from data, and tells if it did
+func writeIfChanged(path string, data []byte, perm os.FileMode) (bool, error) {
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return false, fmt.Errorf("writing %s failed: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return false, fmt.Errorf("renaming %s failed: %v", tmp, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,422 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package watcher
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficserver-ingress-controller/util"
+
+	v1 "k8s.io/api/core/v1"
+	nv1 "k8s.io/api/networking/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	netlisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestTLSSync_WriteCertificates(t *testing.T) {
+	exampleIngress := createExampleIngressWithTLS()
+	exampleIngress.Spec.TLS[0].SecretName = "edge-tls"
+	secret := createExampleTLSSecret(t, "edge-tls")
+	manager, _ := createExampleTLSManager(t, &exampleIngress, &secret)
+	_ = os.WriteFile(manager.ConfigPath, []byte("dest_ip=* ssl_cert_name=/etc/tls/tls.crt ssl_key_name=/etc/tls/tls.key\n"), 0644)
+
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	certFile := filepath.Join(manager.CertDir, "trafficserver-test_edge-tls.crt")
+	keyFile := filepath.Join(manager.CertDir, "trafficserver-test_edge-tls.key")
+	expected := "dest_ip=* ssl_cert_name=/etc/tls/tls.crt ssl_key_name=/etc/tls/tls.key\n" +
+		"ssl_cert_name=" + certFile + " ssl_key_name=" + keyFile + "\n"
+	if returned := readFile(t, manager.ConfigPath); returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+	if returned, expected := readFile(t, certFile), string(secret.Data[v1.TLSCertKey]); returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+	if returned, expected := readFile(t, keyFile), string(secret.Data[v1.TLSPrivateKeyKey]); returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+}
+
+func TestTLSSync_RemoveCertificates(t *testing.T) {
+	exampleIngress := createExampleIngressWithTLS()
+	exampleIngress.Spec.TLS[0].SecretName = "edge-tls"
+	secret := createExampleTLSSecret(t, "edge-tls")
+	manager, igIndexer := createExampleTLSManager(t, &exampleIngress, &secret)
+
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	_ = igIndexer.Delete(&exampleIngress)
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	if returned, expected := readFile(t, manager.ConfigPath), getExpectedSelfSignedConfig(manager); returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+	if returned := getCertDirFiles(manager); !util.IsSameSlice(returned, []string{"default.crt", "default.key"}) {
+		t.Errorf("returned \n%v,  but expected only the self-signed certificate", returned)
+	}
+}
+
+func TestTLSSync_IngressNotIncluded(t *testing.T) {
+	exampleIngress := createExampleIngressWithTLS()
+	exampleIngress.Spec.TLS[0].SecretName = "edge-tls"
+	secret := createExampleTLSSecret(t, "edge-tls")
+	manager, _ := createExampleTLSManager(t, &exampleIngress, &secret)
+	manager.Ep.NsManager.IgnoreNamespaceMap["trafficserver-test"] = true
+
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	if returned := getCertDirFiles(manager); !util.IsSameSlice(returned, []string{"default.crt", "default.key"}) {
+		t.Errorf("returned \n%v,  but expected only the self-signed certificate", returned)
+	}
+}
+
+func TestTLSSync_SecretNotFound(t *testing.T) {
+	exampleIngress := createExampleIngressWithTLS()
+	exampleIngress.Spec.TLS[0].SecretName = "edge-tls"
+	manager, _ := createExampleTLSManager(t, &exampleIngress)
+
+	if err := manager.Sync(nil, nil); err == nil {
+		t.Errorf("Sync returned no error for a missing secret")
+	}
+
+	if returned, expected := readFile(t, manager.ConfigPath), getExpectedSelfSignedConfig(manager); returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+}
+
+func TestTLSSync_ReloadedEvent(t *testing.T) {
+	exampleIngress := createExampleIngressWithTLS()
+	exampleIngress.Spec.TLS[0].SecretName = "edge-tls"
+	secret := createExampleTLSSecret(t, "edge-tls")
+	manager, _ := createExampleTLSManager(t, &exampleIngress, &secret)
+	recorder := record.NewFakeRecorder(10)
+	manager.Recorder = recorder
+
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+	// nothing changed, so nothing is reloaded
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	expected := "Normal Reloaded Reloaded the certificate of secret trafficserver-test/edge-tls, which expires at " +
+		getExampleCertificateExpiry().Format(time.RFC3339)
+	if returned := <-recorder.Events; returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("returned \n%v,  but expected no more events", <-recorder.Events)
+	}
+}
+
+func TestTLSSync_RotatedSecretTouchesConfig(t *testing.T) {
+	exampleIngress := createExampleIngressWithTLS()
+	exampleIngress.Spec.TLS[0].SecretName = "edge-tls"
+	secret := createExampleTLSSecret(t, "edge-tls")
+	manager, _ := createExampleTLSManager(t, &exampleIngress, &secret)
+
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+	config := readFile(t, manager.ConfigPath)
+	old := time.Now().Add(-time.Hour)
+	_ = os.Chtimes(manager.ConfigPath, old, old)
+
+	rotated := createExampleTLSSecret(t, "edge-tls")
+	manager.SecretLister, _ = createExampleSecretLister(&rotated)
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	if returned := readFile(t, manager.ConfigPath); returned != config {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, config)
+	}
+	info, err := os.Stat(manager.ConfigPath)
+	if err != nil {
+		t.Fatalf("Stat returned %v", err)
+	}
+	if !info.ModTime().After(old) {
+		t.Errorf("returned the modification time %v of the config, but expected it touched", info.ModTime())
+	}
+}
+
+func TestTLSSync_RejectInvalidKeyPair(t *testing.T) {
+	exampleIngress := createExampleIngressWithTLS()
+	exampleIngress.Spec.TLS[0].SecretName = "edge-tls"
+	secret := createExampleTLSSecret(t, "edge-tls")
+	manager, _ := createExampleTLSManager(t, &exampleIngress, &secret)
+
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+	config := readFile(t, manager.ConfigPath)
+
+	recorder := record.NewFakeRecorder(10)
+	manager.Recorder = recorder
+	// the key of another certificate
+	otherSecret := createExampleTLSSecret(t, "other-tls")
+	invalidSecret := secret.DeepCopy()
+	invalidSecret.Data[v1.TLSPrivateKeyKey] = otherSecret.Data[v1.TLSPrivateKeyKey]
+	manager.SecretLister, _ = createExampleSecretLister(invalidSecret)
+
+	if err := manager.Sync(nil, nil); err == nil {
+		t.Errorf("Sync returned no error for an invalid key pair")
+	}
+
+	if returned := readFile(t, manager.ConfigPath); returned != config {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, config)
+	}
+	keyFile := filepath.Join(manager.CertDir, "trafficserver-test_edge-tls.key")
+	if returned, expected := readFile(t, keyFile), string(secret.Data[v1.TLSPrivateKeyKey]); returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+	if returned := <-recorder.Events; !strings.HasPrefix(returned, "Warning InvalidCertificate secret trafficserver-test/edge-tls has no valid key pair") {
+		t.Errorf("returned \n%v,  but expected an InvalidCertificate event", returned)
+	}
+}
+
+func TestTLSSync_StaticCertificateRotated(t *testing.T) {
+	exampleIngress := createExampleIngress()
+	manager, _ := createExampleTLSManager(t, &exampleIngress)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	secret := createExampleTLSSecret(t, "static-tls")
+	_ = os.WriteFile(certFile, secret.Data[v1.TLSCertKey], 0644)
+	_ = os.WriteFile(keyFile, secret.Data[v1.TLSPrivateKeyKey], 0600)
+	_ = os.WriteFile(manager.ConfigPath, []byte("dest_ip=* ssl_cert_name="+certFile+" ssl_key_name="+keyFile+"\n"), 0644)
+
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+	if manager.staticChanged() {
+		t.Errorf("returned a change of the static certificate before its rotation")
+	}
+
+	rotated := createExampleTLSSecret(t, "static-tls")
+	_ = os.WriteFile(certFile, rotated.Data[v1.TLSCertKey], 0644)
+	if manager.staticChanged() {
+		t.Errorf("returned a change of the static certificate before its key is rotated")
+	}
+	_ = os.WriteFile(keyFile, rotated.Data[v1.TLSPrivateKeyKey], 0600)
+	if !manager.staticChanged() {
+		t.Errorf("returned no change of the rotated static certificate")
+	}
+}
+
+func TestTLSSync_DefaultSecret(t *testing.T) {
+	exampleIngress := createExampleIngressWithTLS()
+	exampleIngress.Spec.TLS[0].SecretName = "edge-tls"
+	secret := createExampleTLSSecret(t, "edge-tls")
+	defaultSecret := createExampleTLSSecret(t, "default-tls")
+	manager, _ := createExampleTLSManager(t, &exampleIngress, &secret, &defaultSecret)
+	manager.DefaultSecret = "trafficserver-test/default-tls"
+	_ = os.WriteFile(manager.ConfigPath, []byte("dest_ip=* ssl_cert_name=/etc/tls/tls.crt ssl_key_name=/etc/tls/tls.key\n"), 0644)
+
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	base := filepath.Join(manager.CertDir, "trafficserver-test_")
+	expected := "dest_ip=* ssl_cert_name=" + base + "default-tls.crt ssl_key_name=" + base + "default-tls.key\n" +
+		"ssl_cert_name=" + base + "edge-tls.crt ssl_key_name=" + base + "edge-tls.key\n"
+	if returned := readFile(t, manager.ConfigPath); returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+}
+
+func TestTLSSync_DefaultSecretNotFound(t *testing.T) {
+	exampleIngress := createExampleIngress()
+	manager, _ := createExampleTLSManager(t, &exampleIngress)
+	manager.DefaultSecret = "trafficserver-test/default-tls"
+
+	if err := manager.Sync(nil, nil); err == nil {
+		t.Errorf("Sync returned no error for a missing default secret")
+	}
+
+	if returned, expected := readFile(t, manager.ConfigPath), getExpectedSelfSignedConfig(manager); returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+	if _, err := validatePair(manager.selfSigned[0], manager.selfSigned[1]); err != nil {
+		t.Errorf("returned an invalid self-signed certificate: %v", err)
+	}
+}
+
+func TestTLSSync_UpstreamSecrets(t *testing.T) {
+	exampleIngress := createExampleIngress()
+	exampleIngress.Annotations = map[string]string{
+		util.AnnotationProxySSLCASecret:     "backend-ca",
+		util.AnnotationProxySSLClientSecret: "backend-client",
+	}
+	caSecret := createExampleCASecret(t, "backend-ca")
+	clientSecret := createExampleTLSSecret(t, "backend-client")
+	manager, _ := createExampleTLSManager(t, &exampleIngress, &caSecret, &clientSecret)
+
+	if err := manager.Sync(nil, nil); err != nil {
+		t.Fatalf("Sync returned %v", err)
+	}
+
+	// the client certificate is not served
+	if returned, expected := readFile(t, manager.ConfigPath), getExpectedSelfSignedConfig(manager); returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+	expectedFiles := []string{"default.crt", "default.key", "trafficserver-test_backend-ca_ca.crt", "trafficserver-test_backend-client.crt", "trafficserver-test_backend-client.key"}
+	if returned := getCertDirFiles(manager); !util.IsSameSlice(returned, expectedFiles) {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expectedFiles)
+	}
+	caFile := filepath.Join(manager.CertDir, "trafficserver-test_backend-ca_ca.crt")
+	if returned, expected := readFile(t, caFile), string(caSecret.Data["ca.crt"]); returned != expected {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expected)
+	}
+}
+
+func TestTLSSync_RejectInvalidCA(t *testing.T) {
+	exampleIngress := createExampleIngress()
+	exampleIngress.Annotations = map[string]string{util.AnnotationProxySSLCASecret: "backend-ca"}
+	caSecret := createExampleCASecret(t, "backend-ca")
+	caSecret.Data["ca.crt"] = []byte("not a certificate")
+	manager, _ := createExampleTLSManager(t, &exampleIngress, &caSecret)
+	recorder := record.NewFakeRecorder(10)
+	manager.Recorder = recorder
+
+	if err := manager.Sync(nil, nil); err == nil {
+		t.Errorf("Sync returned no error for invalid CA certificates")
+	}
+
+	expectedFiles := []string{"default.crt", "default.key"}
+	if returned := getCertDirFiles(manager); !util.IsSameSlice(returned, expectedFiles) {
+		t.Errorf("returned \n%v,  but expected \n%v", returned, expectedFiles)
+	}
+	if returned := <-recorder.Events; !strings.HasPrefix(returned, "Warning InvalidCertificate secret trafficserver-test/backend-ca has no valid CA certificates") {
+		t.Errorf("returned \n%v,  but expected an InvalidCertificate event", returned)
+	}
+}
+
+func createExampleTLSManager(t *testing.T, ingressObj *nv1.Ingress, secrets ...*v1.Secret) (*TLSManager, cache.Indexer) {
+	exampleEndpoint := createExampleEndpointWithFakeATS()
+	igHandler := IgHandler{ResourceName: "ingresses", Ep: &exampleEndpoint}
+	igIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	_ = igIndexer.Add(ingressObj)
+	igHandler.IgLister = netlisters.NewIngressLister(igIndexer)
+
+	secretLister, _ := createExampleSecretLister(secrets...)
+
+	dir := t.TempDir()
+	return &TLSManager{
+		ResourceName: "tls",
+		Ep:           &exampleEndpoint,
+		IgHandler:    &igHandler,
+		SecretLister: secretLister,
+		CertDir:      filepath.Join(dir, "certs"),
+		ConfigPath:   filepath.Join(dir, "ssl_multicert.config"),
+	}, igIndexer
+}
+
+func createExampleTLSSecret(t *testing.T, name string) v1.Secret {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey returned %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test.edge.com"},
+		DNSNames:     []string{"test.edge.com"},
+		NotBefore:    getExampleCertificateExpiry().AddDate(-1, 0, 0),
+		NotAfter:     getExampleCertificateExpiry(),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate returned %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey returned %v", err)
+	}
+
+	return v1.Secret{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      name,
+			Namespace: "trafficserver-test",
+		},
+		Type: v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+			v1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		},
+	}
+}
+
+func createExampleCASecret(t *testing.T, name string) v1.Secret {
+	secret := createExampleTLSSecret(t, name)
+	secret.Type = v1.SecretTypeOpaque
+	secret.Data = map[string][]byte{"ca.crt": secret.Data[v1.TLSCertKey]}
+	return secret
+}
+
+func getExampleCertificateExpiry() time.Time {
+	return time.Date(2036, time.January, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func createExampleSecretLister(secrets ...*v1.Secret) (corelisters.SecretLister, cache.Indexer) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, secret := range secrets {
+		_ = indexer.Add(secret)
+	}
+	return corelisters.NewSecretLister(indexer), indexer
+}
+
+func getExpectedSelfSignedConfig(manager *TLSManager) string {
+	base := filepath.Join(manager.CertDir, "default")
+	return "dest_ip=* ssl_cert_name=" + base + ".crt ssl_key_name=" + base + ".key\n"
+}
+
+func getCertDirFiles(manager *TLSManager) []string {
+	entries, _ := os.ReadDir(manager.CertDir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(data)
+}
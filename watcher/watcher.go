@@ -19,17 +19,23 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/apache/trafficserver-ingress-controller/endpoint"
 	"github.com/apache/trafficserver-ingress-controller/proxy"
 	nv1 "k8s.io/api/networking/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	pkgruntime "k8s.io/apimachinery/pkg/runtime"
@@ -41,6 +47,11 @@ import (
 
 const CACHE_PATH string = "/opt/ats/etc/trafficserver/cache.config"
 const SNI_PATH string = "/opt/ats/etc/trafficserver/sni.yaml"
+const SSL_MULTICERT_PATH string = "/opt/ats/etc/trafficserver/ssl_multicert.config"
+
+// STATIC_CERT_POLL_PERIOD is how often the certificates mounted into the pod
+// are checked for rotation
+const STATIC_CERT_POLL_PERIOD = 30 * time.Second
 
 // FIXME: watching all namespace does not work...
 
@@ -52,6 +63,49 @@ type Watcher struct {
 	ResyncPeriod  time.Duration
 	Ep            *endpoint.Endpoint
 	StopChan      chan struct{}
+	// UseEndpointSlices watches discovery/v1 EndpointSlices instead of the
+	// core/v1 Endpoints for the backends of Services
+	UseEndpointSlices bool
+	// DrainTimeout is how long terminating EndpointSlice endpoints stay
+	// routable while their Service has no ready endpoint
+	DrainTimeout time.Duration
+	// ReconcilePeriod is how often Redis is reconciled with the cluster
+	// state as a whole. Zero only reconciles at startup and on demand.
+	ReconcilePeriod time.Duration
+	// Leader gates the writes to cluster-scoped state. It is nil when
+	// leader election is disabled, and then every replica writes.
+	Leader *Leadership
+	// PublishService is the namespace/name of the ATS Service whose
+	// addresses are published to the status of the admitted Ingresses
+	PublishService string
+	// PublishStatusAddresses are published instead of the addresses of
+	// PublishService when given
+	PublishStatusAddresses []string
+	// IngressController is the spec.controller of the IngressClasses whose
+	// Ingresses are served. IngressClasses are not watched when it is empty.
+	IngressController string
+	// IngressClassAnnotation accepts the Ingresses whose class is only
+	// given by the legacy kubernetes.io/ingress.class annotation
+	IngressClassAnnotation bool
+	// TLSCertDir is where the certificates of the Secrets referenced by
+	// spec.tls are written. They are not managed when it is empty.
+	TLSCertDir string
+	// DefaultSSLCertificate is the namespace/name of the Secret of the
+	// certificate for the hosts no Ingress has one for
+	DefaultSSLCertificate string
+	// SSLRedirect redirects plain http requests for TLS hosts to https by
+	// default
+	SSLRedirect bool
+	// Snippets accepts the server-snippets of the Ingresses in the
+	// SnippetNamespaces, or in any namespace when SnippetNamespaces is nil
+	Snippets          bool
+	SnippetNamespaces map[string]bool
+
+	factory  informers.SharedInformerFactory
+	recorder record.EventRecorder
+	// queue is shared by the handlers writing routes to Redis
+	queue      *Queue
+	reconciler *Reconciler
 }
 
 // EventHandler interface defines the 3 required methods to implement for watchers
@@ -64,22 +118,94 @@ type EventHandler interface {
 
 // Watch creates necessary threads to watch over resources
 func (w *Watcher) Watch() error {
+	factory := w.informerFactory()
+	igHandler := IgHandler{
+		ResourceName: "ingresses",
+		Ep:           w.Ep,
+		SvcLister:    factory.Core().V1().Services().Lister(),
+		IgLister:     factory.Networking().V1().Ingresses().Lister(),
+
+		ClassAnnotation: w.IngressClassAnnotation,
+		SSLRedirect:     w.SSLRedirect,
+		CertDir:         w.TLSCertDir,
+
+		Snippets:          w.Snippets,
+		SnippetNamespaces: w.SnippetNamespaces,
+		Recorder:          w.eventRecorder(),
+	}
+	if w.UseEndpointSlices {
+		igHandler.SliceLister = factory.Discovery().V1().EndpointSlices().Lister()
+	} else {
+		igHandler.EpLister = factory.Core().V1().Endpoints().Lister()
+	}
+	epHandler := EpHandler{"endpoints", w.Ep, &igHandler}
+	sliceHandler := EpSliceHandler{
+		ResourceName: "endpointslices",
+		Ep:           w.Ep,
+		SliceLister:  igHandler.SliceLister,
+		IgHandler:    &igHandler,
+		DrainTimeout: w.DrainTimeout,
+		Queue:        w.routeQueue(),
+	}
+	//================= Watch for Services ==================
+	// Services are synced first so that ingress backend ports resolve
+	svcHandler := SvcHandler{ResourceName: "services", Ep: w.Ep, IgHandler: &igHandler, Endpoints: &epHandler}
+	if w.UseEndpointSlices {
+		svcHandler.Endpoints = &sliceHandler
+	}
+	svcListWatch := cache.NewListWatchFromClient(w.Cs.CoreV1().RESTClient(), svcHandler.GetResourceName(), v1.NamespaceAll, fields.Everything())
+	err := w.allNamespacesWatchFor(&svcHandler, w.Cs.CoreV1().RESTClient(),
+		fields.Everything(), &v1.Service{}, w.ResyncPeriod, svcListWatch)
+	if err != nil {
+		return err
+	}
+	//================= Watch for IngressClasses ==================
+	// classes are synced before ingresses so that the first ingress sync
+	// already tells which ones are served
+	if w.IngressController != "" {
+		if err := w.watchIngressClasses(&igHandler); err != nil {
+			return err
+		}
+	}
 	//================= Watch for Ingress ==================
-	igHandler := IgHandler{"ingresses", w.Ep}
 	igListWatch := cache.NewListWatchFromClient(w.Cs.NetworkingV1().RESTClient(), igHandler.GetResourceName(), v1.NamespaceAll, fields.Everything())
-	err := w.allNamespacesWatchFor(&igHandler, w.Cs.NetworkingV1().RESTClient(),
+	err = w.allNamespacesWatchFor(&igHandler, w.Cs.NetworkingV1().RESTClient(),
 		fields.Everything(), &nv1.Ingress{}, w.ResyncPeriod, igListWatch)
 	if err != nil {
 		return err
 	}
-	//================= Watch for Endpoints =================
-	epHandler := EpHandler{"endpoints", w.Ep}
-	epListWatch := cache.NewListWatchFromClient(w.Cs.CoreV1().RESTClient(), epHandler.GetResourceName(), v1.NamespaceAll, fields.Everything())
-	err = w.allNamespacesWatchFor(&epHandler, w.Cs.CoreV1().RESTClient(),
-		fields.Everything(), &v1.Endpoints{}, w.ResyncPeriod, epListWatch)
+	w.reconciler = &Reconciler{ResourceName: "reconcile", Ep: w.Ep, IgHandler: &igHandler}
+	if w.UseEndpointSlices {
+		//================= Watch for EndpointSlices =================
+		sliceListWatch := cache.NewListWatchFromClient(w.Cs.DiscoveryV1().RESTClient(), sliceHandler.GetResourceName(), v1.NamespaceAll, fields.Everything())
+		err = w.allNamespacesWatchFor(&sliceHandler, w.Cs.DiscoveryV1().RESTClient(),
+			fields.Everything(), &discoveryv1.EndpointSlice{}, w.ResyncPeriod, sliceListWatch)
+		w.reconciler.SliceHandler = &sliceHandler
+	} else {
+		//================= Watch for Endpoints =================
+		epListWatch := cache.NewListWatchFromClient(w.Cs.CoreV1().RESTClient(), epHandler.GetResourceName(), v1.NamespaceAll, fields.Everything())
+		err = w.allNamespacesWatchFor(&epHandler, w.Cs.CoreV1().RESTClient(),
+			fields.Everything(), &v1.Endpoints{}, w.ResyncPeriod, epListWatch)
+	}
 	if err != nil {
 		return err
 	}
+	//================= Publish Ingress Status =================
+	if w.PublishService != "" || len(w.PublishStatusAddresses) > 0 {
+		if err := w.watchStatus(&igHandler); err != nil {
+			return err
+		}
+	}
+	//================= Manage TLS Certificates =================
+	if w.TLSCertDir != "" {
+		if err := w.watchTLS(&igHandler, SSL_MULTICERT_PATH); err != nil {
+			return err
+		}
+	}
+	//================= Reconcile Redis =================
+	// the routes now resolve against synced caches. The first run sweeps
+	// the keys no Ingress owns, e.g. snippets of older Ingress versions.
+	go w.reconcileEvery(w.ReconcilePeriod)
 	//================= Watch for ConfigMaps =================
 	cmHandler := CMHandler{"configmaps", w.Ep}
 	targetNs := make([]string, 1)
@@ -106,20 +232,20 @@ func (w *Watcher) allNamespacesWatchFor(h EventHandler, c cache.Getter,
 	fieldSelector fields.Selector, objType pkgruntime.Object,
 	resyncPeriod time.Duration, listerWatcher cache.ListerWatcher) error {
 
-	factory := informers.NewSharedInformerFactory(w.Cs, resyncPeriod)
+	factory := w.informerFactory()
 	var sharedInformer cache.SharedIndexInformer
 	switch objType.(type) {
 	case *v1.Endpoints:
 		sharedInformer = factory.Core().V1().Endpoints().Informer()
+	case *v1.Service:
+		sharedInformer = factory.Core().V1().Services().Informer()
+	case *discoveryv1.EndpointSlice:
+		sharedInformer = factory.Discovery().V1().EndpointSlices().Informer()
 	case *nv1.Ingress:
 		sharedInformer = factory.Networking().V1().Ingresses().Informer()
 	}
 
-	_, err := sharedInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    h.Add,
-		UpdateFunc: h.Update,
-		DeleteFunc: h.Delete,
-	})
+	_, err := sharedInformer.AddEventHandlerWithResyncPeriod(eventHandlerFor(h, w.routeQueue()), resyncPeriod)
 	if err != nil {
 		return err
 	}
@@ -134,6 +260,302 @@ func (w *Watcher) allNamespacesWatchFor(h EventHandler, c cache.Getter,
 	return nil
 }
 
+// watchIngressClasses resolves the classes of the Ingresses through the
+// IngressClasses. Which Ingresses are served may change with any class, so
+// every change reconciles the routes as a whole.
+func (w *Watcher) watchIngressClasses(igHandler *IgHandler) error {
+	informer := w.informerFactory().Networking().V1().IngressClasses().Informer()
+	igHandler.ClassLister = w.informerFactory().Networking().V1().IngressClasses().Lister()
+	igHandler.Controller = w.IngressController
+
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { w.Reconcile() },
+		UpdateFunc: func(obj, newObj interface{}) {
+			if versionChanged(obj, newObj) {
+				w.Reconcile()
+			}
+		},
+		DeleteFunc: func(interface{}) { w.Reconcile() },
+	})
+	if err != nil {
+		return err
+	}
+
+	go informer.Run(w.StopChan)
+
+	if !cache.WaitForCacheSync(w.StopChan, informer.HasSynced) {
+		s := "Timed out waiting for ingressclasses caches to sync"
+		utilruntime.HandleError(errors.New(s))
+		return errors.New(s)
+	}
+	return nil
+}
+
+// versionChanged tells an update of an object from the periodic resyncs
+// of the informers, which carry the same version
+func versionChanged(obj, newObj interface{}) bool {
+	meta, err := apimeta.Accessor(obj)
+	newMeta, newErr := apimeta.Accessor(newObj)
+	return err != nil || newErr != nil || meta.GetResourceVersion() != newMeta.GetResourceVersion()
+}
+
+// watchStatus keeps the status of the Ingresses in line with the addresses
+// of ATS, which are re-published when the ATS Service or its endpoints
+// change and when this replica starts leading
+func (w *Watcher) watchStatus(igHandler *IgHandler) error {
+	updater := &StatusUpdater{
+		ResourceName:   "ingressstatus",
+		Cs:             w.Cs,
+		IgHandler:      igHandler,
+		Addresses:      w.PublishStatusAddresses,
+		PublishService: w.PublishService,
+		Leader:         w.Leader,
+	}
+	queue := w.startQueue(updater.GetResourceName())
+
+	factory := w.informerFactory()
+	if _, err := factory.Networking().V1().Ingresses().Informer().AddEventHandler(queue.EventHandlerFor(updater)); err != nil {
+		return err
+	}
+
+	if w.PublishService != "" {
+		namespace, name, _ := strings.Cut(w.PublishService, "/")
+		resync := cache.FilteringResourceEventHandler{
+			FilterFunc: func(obj interface{}) bool {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					obj = tombstone.Obj
+				}
+				meta, err := apimeta.Accessor(obj)
+				if err != nil || meta.GetNamespace() != namespace {
+					return false
+				}
+				return meta.GetName() == name || meta.GetLabels()[discoveryv1.LabelServiceName] == name
+			},
+			Handler: cache.ResourceEventHandlerFuncs{
+				AddFunc:    func(interface{}) { queue.Resync(updater) },
+				UpdateFunc: func(_, _ interface{}) { queue.Resync(updater) },
+				DeleteFunc: func(interface{}) { queue.Resync(updater) },
+			},
+		}
+		informers := []cache.SharedIndexInformer{factory.Core().V1().Services().Informer()}
+		if w.UseEndpointSlices {
+			informers = append(informers, factory.Discovery().V1().EndpointSlices().Informer())
+		} else {
+			informers = append(informers, factory.Core().V1().Endpoints().Informer())
+		}
+		for _, informer := range informers {
+			if _, err := informer.AddEventHandler(resync); err != nil {
+				return err
+			}
+		}
+
+		// the addresses of the nodes are read from their cache, which
+		// changes in them refresh
+		nodeInformer := factory.Core().V1().Nodes().Informer()
+		updater.NodeLister = factory.Core().V1().Nodes().Lister()
+		_, err := nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(obj, newObj interface{}) {
+				node, ok := obj.(*v1.Node)
+				newNode, newOk := newObj.(*v1.Node)
+				if ok && newOk && nodeAddress(node) != nodeAddress(newNode) {
+					queue.Resync(updater)
+				}
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		go nodeInformer.Run(w.StopChan)
+
+		if !cache.WaitForCacheSync(w.StopChan, nodeInformer.HasSynced) {
+			s := "Timed out waiting for nodes caches to sync"
+			utilruntime.HandleError(errors.New(s))
+			return errors.New(s)
+		}
+	}
+
+	if igHandler.ClassLister != nil {
+		_, err := factory.Networking().V1().IngressClasses().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(interface{}) { queue.Resync(updater) },
+			UpdateFunc: func(obj, newObj interface{}) {
+				if versionChanged(obj, newObj) {
+					queue.Resync(updater)
+				}
+			},
+			DeleteFunc: func(interface{}) { queue.Resync(updater) },
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	w.Leader.OnChange(func(leading bool) {
+		if leading {
+			queue.Resync(updater)
+		}
+	})
+	queue.Resync(updater)
+	return nil
+}
+
+// watchTLS keeps ssl_multicert.config at path in line with the Secrets
+// referenced by the Ingresses, which are all rewritten whenever one of the
+// Ingresses, their classes or the TLS Secrets change
+func (w *Watcher) watchTLS(igHandler *IgHandler, path string) error {
+	factory := w.informerFactory()
+	manager := &TLSManager{
+		ResourceName: "tls",
+		Ep:           w.Ep,
+		IgHandler:    igHandler,
+		SecretLister: factory.Core().V1().Secrets().Lister(),
+		CertDir:      w.TLSCertDir,
+		ConfigPath:   path,
+		Recorder:     w.eventRecorder(),
+
+		DefaultSecret: w.DefaultSSLCertificate,
+	}
+	queue := w.startQueue(manager.GetResourceName())
+
+	resync := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(interface{}) { queue.Resync(manager) },
+		UpdateFunc: func(obj, newObj interface{}) {
+			if versionChanged(obj, newObj) {
+				queue.Resync(manager)
+			}
+		},
+		DeleteFunc: func(interface{}) { queue.Resync(manager) },
+	}
+	if _, err := factory.Networking().V1().Ingresses().Informer().AddEventHandler(resync); err != nil {
+		return err
+	}
+	if igHandler.ClassLister != nil {
+		if _, err := factory.Networking().V1().IngressClasses().Informer().AddEventHandler(resync); err != nil {
+			return err
+		}
+	}
+
+	informer := factory.Core().V1().Secrets().Informer()
+	_, err := informer.AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			secret, ok := obj.(*v1.Secret)
+			return ok && (len(secret.Data[v1.TLSCertKey]) > 0 || len(secret.Data[caCertKey]) > 0)
+		},
+		Handler: resync,
+	})
+	if err != nil {
+		return err
+	}
+
+	go informer.Run(w.StopChan)
+
+	if !cache.WaitForCacheSync(w.StopChan, informer.HasSynced) {
+		s := "Timed out waiting for secrets caches to sync"
+		utilruntime.HandleError(errors.New(s))
+		return errors.New(s)
+	}
+	queue.Resync(manager)
+
+	// mounted certificates are rotated without any event
+	go func() {
+		ticker := time.NewTicker(STATIC_CERT_POLL_PERIOD)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				queue.Resync(manager)
+			case <-w.StopChan:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Reconcile queues a reconciliation of Redis with the cluster state after
+// the pending route changes
+func (w *Watcher) Reconcile() {
+	if w.reconciler != nil {
+		w.routeQueue().Resync(w.reconciler)
+	}
+}
+
+// reconcileEvery reconciles Redis right away and then every period, until
+// StopChan is closed
+func (w *Watcher) reconcileEvery(period time.Duration) {
+	w.Reconcile()
+	if period <= 0 {
+		return
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.Reconcile()
+		case <-w.StopChan:
+			return
+		}
+	}
+}
+
+// informerFactory returns the factory shared by the informers watching all
+// namespaces, so that handlers can read other resources through its listers
+func (w *Watcher) informerFactory() informers.SharedInformerFactory {
+	if w.factory == nil {
+		w.factory = informers.NewSharedInformerFactory(w.Cs, w.ResyncPeriod)
+	}
+	return w.factory
+}
+
+// eventRecorder returns the recorder of the Events about the resources the
+// controller acts on, which only the leader posts
+func (w *Watcher) eventRecorder() record.EventRecorder {
+	if w.recorder == nil {
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: w.Cs.CoreV1().Events(v1.NamespaceAll)})
+		w.recorder = leaderRecorder{
+			EventRecorder: broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "ats-ingress-controller"}),
+			leader:        w.Leader,
+		}
+	}
+	return w.recorder
+}
+
+// routeQueue returns the Queue of the handlers writing routes to Redis, so
+// that they never write concurrently. Their changes are published once the
+// Queue is done with them.
+func (w *Watcher) routeQueue() *Queue {
+	if w.queue == nil {
+		w.queue = w.startQueue("routes")
+		w.queue.SyncAfter(&Publisher{ResourceName: "publish", Ep: w.Ep})
+	}
+	return w.queue
+}
+
+// startQueue creates a Queue syncing until StopChan is closed
+func (w *Watcher) startQueue(name string) *Queue {
+	q := NewQueue(name)
+	go q.Run(w.StopChan)
+	return q
+}
+
+// eventHandlerFor returns the informer callbacks of h, which go through q
+// when h is a Syncer
+func eventHandlerFor(h EventHandler, q *Queue) cache.ResourceEventHandler {
+	if s, ok := h.(Syncer); ok {
+		return q.EventHandlerFor(s)
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    h.Add,
+		UpdateFunc: h.Update,
+		DeleteFunc: h.Delete,
+	}
+}
+
 // This is meant to make it easier to add resource watchers on resources that
 // span multiple namespaces
 func (w *Watcher) inNamespacesWatchFor(h EventHandler, c cache.Getter,
@@ -143,6 +565,7 @@ func (w *Watcher) inNamespacesWatchFor(h EventHandler, c cache.Getter,
 		log.Panicln("inNamespacesWatchFor must have at least 1 namespace")
 	}
 	syncFuncs := make([]cache.InformerSynced, len(namespaces))
+	queue := w.startQueue(h.GetResourceName())
 	for i, ns := range namespaces {
 		factory := informers.NewSharedInformerFactoryWithOptions(w.Cs, resyncPeriod, informers.WithNamespace(ns))
 
@@ -156,11 +579,7 @@ func (w *Watcher) inNamespacesWatchFor(h EventHandler, c cache.Getter,
 			sharedInformer = factory.Core().V1().ConfigMaps().Informer()
 		}
 
-		_, err := sharedInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-			AddFunc:    h.Add,
-			UpdateFunc: h.Update,
-			DeleteFunc: h.Delete,
-		})
+		_, err := sharedInformer.AddEventHandler(eventHandlerFor(h, queue))
 		if err != nil {
 			return err
 		}
@@ -182,11 +601,7 @@ func (w *Watcher) WatchAtsCachingPolicy(path string) error {
 	dynamicFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(w.DynamicClient, w.ResyncPeriod, metav1.NamespaceAll, nil)
 	informer := dynamicFactory.ForResource(gvr).Informer()
 	cachehandler := NewAtsCacheHandler("atscaching", w.Ep, path)
-	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    cachehandler.Add,
-		UpdateFunc: cachehandler.Update,
-		DeleteFunc: cachehandler.Delete,
-	})
+	_, err := informer.AddEventHandler(eventHandlerFor(cachehandler, w.startQueue(cachehandler.GetResourceName())))
 
 	if err != nil {
 		return fmt.Errorf("failed to add event handler: %v", err)
@@ -205,11 +620,7 @@ func (w *Watcher) WatchAtsSniPolicy(path string) error {
 	dynamicFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(w.DynamicClient, w.ResyncPeriod, metav1.NamespaceAll, nil)
 	informer := dynamicFactory.ForResource(gvr).Informer()
 	snihandler := NewAtsSniHandler("atssnipolicy", w.Ep, path)
-	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    snihandler.Add,
-		UpdateFunc: snihandler.Update,
-		DeleteFunc: snihandler.Delete,
-	})
+	_, err := informer.AddEventHandler(eventHandlerFor(snihandler, w.startQueue(snihandler.GetResourceName())))
 
 	if err != nil {
 		return fmt.Errorf("failed to add event handler: %v", err)
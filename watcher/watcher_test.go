@@ -25,7 +25,7 @@ import (
 func TestAllNamespacesWatchFor_Add(t *testing.T) {
 	w, fc := getTestWatcher()
 
-	epHandler := EpHandler{"endpoints", w.Ep}
+	epHandler := EpHandler{ResourceName: "endpoints", Ep: w.Ep}
 	err := w.allNamespacesWatchFor(&epHandler, w.Cs.CoreV1().RESTClient(),
 		fields.Everything(), &v1.Endpoints{}, 0, fc)
 
@@ -64,7 +64,7 @@ func TestAllNamespacesWatchFor_Add(t *testing.T) {
 func TestAllNamespacesWatchFor_Update(t *testing.T) {
 	w, fc := getTestWatcher()
 
-	epHandler := EpHandler{"endpoints", w.Ep}
+	epHandler := EpHandler{ResourceName: "endpoints", Ep: w.Ep}
 	err := w.allNamespacesWatchFor(&epHandler, w.Cs.CoreV1().RESTClient(),
 		fields.Everything(), &v1.Endpoints{}, 0, fc)
 
@@ -124,7 +124,7 @@ func TestAllNamespacesWatchFor_Update(t *testing.T) {
 func TestAllNamespacesWatchFor_Delete(t *testing.T) {
 	w, fc := getTestWatcher()
 
-	epHandler := EpHandler{"endpoints", w.Ep}
+	epHandler := EpHandler{ResourceName: "endpoints", Ep: w.Ep}
 	err := w.allNamespacesWatchFor(&epHandler, w.Cs.CoreV1().RESTClient(),
 		fields.Everything(), &v1.Endpoints{}, 0, fc)
 